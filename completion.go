@@ -0,0 +1,152 @@
+// completion.go
+//
+// Support for -completion, which prints a tab-completion script for bash, zsh or fish.
+// Scripts are generated from the registered flags so they never fall out of date.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pdfinn/wmse_downloader/wmse"
+)
+
+// completionShells are the shells -completion can generate scripts for
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// fileFlags are flags whose value is a path, completed from the filesystem
+var fileFlags = map[string]bool{
+	"out":           true,
+	"log-file":      true,
+	"archives-file": true,
+	"concat":        true,
+	"config":        true,
+}
+
+// flagValues lists the accepted values of flags that take one of a fixed set
+func flagValues() map[string][]string {
+	return map[string][]string{
+		"backoff":         wmse.BackoffNames,
+		"completion":      completionShells,
+		"log-format":      logFormats,
+		"log-level":       logLevels,
+		"media-library":   mediaLibraries,
+		"order":           wmse.ArchiveOrders,
+		"overwrite":       wmse.OverwriteModes,
+		"playlist-format": wmse.PlaylistFormats,
+		"progress-mode":   wmse.ProgressModes,
+	}
+}
+
+// isBoolFlag reports whether f is a switch that takes no value
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// writeCompletion writes a completion script for shell covering every flag in fs
+func writeCompletion(fs *flag.FlagSet, shell string, w io.Writer) error {
+	switch shell {
+	case "bash":
+		return bashCompletion(fs, w)
+	case "zsh":
+		return zshCompletion(fs, w)
+	case "fish":
+		return fishCompletion(fs, w)
+	default:
+		return fmt.Errorf("unsupported shell %q (want one of %s)", shell, strings.Join(completionShells, ", "))
+	}
+}
+
+func bashCompletion(fs *flag.FlagSet, w io.Writer) error {
+	values := flagValues()
+	var names, files, other []string
+	var cases strings.Builder
+	fs.VisitAll(func(f *flag.Flag) {
+		names = append(names, "-"+f.Name)
+		switch {
+		case isBoolFlag(f):
+		case fileFlags[f.Name]:
+			files = append(files, "-"+f.Name)
+		case values[f.Name] != nil:
+			fmt.Fprintf(&cases, "        -%s)\n            COMPREPLY=($(compgen -W %q -- \"$cur\"))\n            return ;;\n",
+				f.Name, strings.Join(values[f.Name], " "))
+		default:
+			other = append(other, "-"+f.Name)
+		}
+	})
+
+	var sb strings.Builder
+	sb.WriteString("# bash completion for wmse_downloader\n")
+	sb.WriteString("_wmse_downloader() {\n")
+	sb.WriteString("    local cur=\"${COMP_WORDS[COMP_CWORD]}\"\n")
+	sb.WriteString("    local prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+	sb.WriteString("    case \"$prev\" in\n")
+	sb.WriteString(cases.String())
+	if len(files) > 0 {
+		fmt.Fprintf(&sb, "        %s)\n            COMPREPLY=($(compgen -f -- \"$cur\"))\n            return ;;\n", strings.Join(files, "|"))
+	}
+	if len(other) > 0 {
+		fmt.Fprintf(&sb, "        %s)\n            COMPREPLY=()\n            return ;;\n", strings.Join(other, "|"))
+	}
+	sb.WriteString("    esac\n")
+	fmt.Fprintf(&sb, "    COMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(names, " "))
+	sb.WriteString("}\n")
+	sb.WriteString("complete -F _wmse_downloader wmse_downloader\n")
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func zshCompletion(fs *flag.FlagSet, w io.Writer) error {
+	values := flagValues()
+	escape := strings.NewReplacer(`'`, `'\''`, `[`, `\[`, `]`, `\]`, `:`, `\:`)
+
+	var sb strings.Builder
+	sb.WriteString("#compdef wmse_downloader\n")
+	sb.WriteString("_arguments")
+	fs.VisitAll(func(f *flag.Flag) {
+		spec := fmt.Sprintf("-%s[%s]", f.Name, escape.Replace(f.Usage))
+		switch {
+		case isBoolFlag(f):
+		case fileFlags[f.Name]:
+			spec += ":file:_files"
+		case values[f.Name] != nil:
+			spec += fmt.Sprintf(":%s:(%s)", f.Name, strings.Join(values[f.Name], " "))
+		default:
+			spec += ":" + f.Name + ":"
+		}
+		fmt.Fprintf(&sb, " \\\n  '%s'", spec)
+	})
+	sb.WriteString("\n")
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func fishCompletion(fs *flag.FlagSet, w io.Writer) error {
+	values := flagValues()
+	quote := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+	var sb strings.Builder
+	sb.WriteString("# fish completion for wmse_downloader\n")
+	fs.VisitAll(func(f *flag.Flag) {
+		fmt.Fprintf(&sb, "complete -c wmse_downloader -o %s -d '%s'", f.Name, quote.Replace(f.Usage))
+		switch {
+		case isBoolFlag(f):
+		case fileFlags[f.Name]:
+			sb.WriteString(" -r -F")
+		case values[f.Name] != nil:
+			fmt.Fprintf(&sb, " -x -a '%s'", strings.Join(values[f.Name], " "))
+		default:
+			sb.WriteString(" -x")
+		}
+		sb.WriteString("\n")
+	})
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
@@ -0,0 +1,250 @@
+// config.go
+//
+// Support for -config and -print-config. A config file is a JSON object of flag names and
+// values, e.g. {"show": "ded", "out": "/srv/wmse/ded", "delay": "5s"}, so a cron job can
+// keep its settings in one place. Flags given on the command line win over the file.
+//
+// A "shows" list gives settings for individual shows, e.g.
+// {"out": "/srv/wmse", "shows": [{"show": "ded", "out": "ded", "tags": true}, {"show": "jazz"}]}.
+// Each entry names a show and any of showFlags that differ for it; a relative "out" is a
+// directory under the top-level one. Without -show on the command line, the listed shows
+// are the ones downloaded.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pdfinn/wmse_downloader/wmse"
+)
+
+// unconfigurableFlags are flags that make no sense in a config file
+var unconfigurableFlags = map[string]bool{
+	"config":       true,
+	"print-config": true,
+	"version":      true,
+	"describe":     true,
+	"completion":   true,
+}
+
+// showConfig is one entry of a config file's "shows" list: a show ID and the settings that
+// differ for it, as flag names and values
+type showConfig struct {
+	Show     string
+	Settings map[string]string
+}
+
+// loadConfig sets each flag named in the config file at path, except flags already given
+// on the command line, and returns the file's "shows" list
+func loadConfig(fs *flag.FlagSet, path string) ([]showConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config file: %w", err)
+	}
+	var values map[string]any
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("could not parse config file %s: %w", path, err)
+	}
+
+	var shows []showConfig
+	if list, ok := values["shows"]; ok {
+		if _, ok := values["show"]; ok {
+			return nil, fmt.Errorf("config file %s: give either \"show\" or \"shows\", not both", path)
+		}
+		if shows, err = parseShowConfigs(list); err != nil {
+			return nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+		delete(values, "shows")
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		if fs.Lookup(name) == nil || unconfigurableFlags[name] {
+			return nil, fmt.Errorf("config file %s: unknown setting %q", path, name)
+		}
+		if explicit[name] {
+			continue
+		}
+
+		value, ok := configString(values[name])
+		if !ok {
+			return nil, fmt.Errorf("config file %s: %q must be a string, number or boolean", path, name)
+		}
+		if err := fs.Set(name, value); err != nil {
+			return nil, fmt.Errorf("config file %s: %q: %w", path, name, err)
+		}
+	}
+	return shows, nil
+}
+
+// configString returns a config file value in the form a flag is set from
+func configString(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	default:
+		return "", false
+	}
+}
+
+// parseShowConfigs reads a config file's "shows" list, checking each setting against
+// showFlags
+func parseShowConfigs(list any) ([]showConfig, error) {
+	entries, ok := list.([]any)
+	if !ok {
+		return nil, errors.New(`"shows" must be a list`)
+	}
+	known := showFlags(&wmse.Options{}, &selection{}, new(string))
+
+	var shows []showConfig
+	seen := make(map[string]bool)
+	for i, entry := range entries {
+		values, ok := entry.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("shows[%d] must be an object", i)
+		}
+		show, _ := values["show"].(string)
+		if show == "" {
+			return nil, fmt.Errorf("shows[%d] has no \"show\"", i)
+		}
+		if seen[show] {
+			return nil, fmt.Errorf("show %s is listed twice", show)
+		}
+		seen[show] = true
+
+		cfg := showConfig{Show: show, Settings: make(map[string]string)}
+		for name, v := range values {
+			if name == "show" {
+				continue
+			}
+			if known.Lookup(name) == nil {
+				return nil, fmt.Errorf("show %s: %q cannot be set per show", show, name)
+			}
+			value, ok := configString(v)
+			if !ok {
+				return nil, fmt.Errorf("show %s: %q must be a string, number or boolean", show, name)
+			}
+			cfg.Settings[name] = value
+		}
+		shows = append(shows, cfg)
+	}
+	return shows, nil
+}
+
+// showFlags returns the settings a "shows" entry may change, bound to o, sel and out
+func showFlags(o *wmse.Options, sel *selection, out *string) *flag.FlagSet {
+	fs := flag.NewFlagSet("shows", flag.ContinueOnError)
+	fs.StringVar(out, "out", "", "")
+	fs.StringVar(&o.FilenameTemplate, "template", o.FilenameTemplate, "")
+	fs.DurationVar(&o.Delay, "delay", o.Delay, "")
+	fs.BoolVar(&o.Tags, "tags", o.Tags, "")
+	fs.BoolVar(&o.Chapters, "chapters", o.Chapters, "")
+	fs.StringVar(&o.PlaylistFormat, "playlist-format", o.PlaylistFormat, "")
+	fs.StringVar(&sel.ArchiveID, "archive-id", sel.ArchiveID, "")
+	fs.StringVar(&sel.ArchivesFile, "archives-file", sel.ArchivesFile, "")
+	fs.IntVar(&sel.StartIndex, "start-index", sel.StartIndex, "")
+	fs.IntVar(&sel.EndIndex, "end-index", sel.EndIndex, "")
+	fs.IntVar(&sel.Limit, "limit", sel.Limit, "")
+	fs.StringVar(&sel.Order, "order", sel.Order, "")
+	fs.BoolVar(&sel.SinceLastRun, "since-last-run", sel.SinceLastRun, "")
+	return fs
+}
+
+// flagSource is where a flag's value came from
+type flagSource int
+
+const (
+	flagUnset       flagSource = iota // Left at its default
+	fromCommandLine                   // Given on the command line
+	fromSettings                      // Set by the config file or a -media-library preset
+)
+
+// applyShowConfig returns o and sel with the settings of cfg applied, except those given on
+// the command line by setBy. A relative "out" is taken as a directory under o.OutputDir.
+func applyShowConfig(o wmse.Options, sel selection, cfg showConfig, setBy map[string]flagSource) (wmse.Options, selection, error) {
+	var out string
+	fs := showFlags(&o, &sel, &out)
+	for _, name := range slices.Sorted(maps.Keys(cfg.Settings)) {
+		// -out on the command line moves every show, but each keeps its own directory
+		if setBy[name] == fromCommandLine && name != "out" {
+			continue
+		}
+		if err := fs.Set(name, cfg.Settings[name]); err != nil {
+			return o, sel, fmt.Errorf("show %s: %q: %w", cfg.Show, name, err)
+		}
+	}
+
+	if !slices.Contains(wmse.ArchiveOrders, sel.Order) {
+		return o, sel, fmt.Errorf("show %s: unknown order %q (want one of %s)", cfg.Show, sel.Order, strings.Join(wmse.ArchiveOrders, ", "))
+	}
+	if out != "" {
+		out, err := expandHome(out)
+		if err != nil {
+			return o, sel, err
+		}
+		if !filepath.IsAbs(out) {
+			out = filepath.Join(o.OutputDir, out)
+		}
+		o.OutputDir = out
+	}
+	return o, sel, nil
+}
+
+// configValue returns a flag's current value as it would be written in a config file
+func configValue(f *flag.Flag) any {
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return f.Value.String()
+	}
+	switch v := getter.Get().(type) {
+	case bool, int, int64, uint, uint64, float64:
+		return v
+	case time.Duration:
+		return v.String()
+	default:
+		return f.Value.String()
+	}
+}
+
+// printConfig writes the effective value of every configurable flag, and the "shows" list
+// if there is one, to w as a config file
+func printConfig(fs *flag.FlagSet, shows []showConfig, w io.Writer) error {
+	values := make(map[string]any)
+	fs.VisitAll(func(f *flag.Flag) {
+		if !unconfigurableFlags[f.Name] {
+			values[f.Name] = configValue(f)
+		}
+	})
+	if len(shows) > 0 {
+		// The list decides the shows, so a top-level show would be rejected when read back
+		delete(values, "show")
+		list := make([]map[string]string, 0, len(shows))
+		for _, cfg := range shows {
+			entry := map[string]string{"show": cfg.Show}
+			maps.Copy(entry, cfg.Settings)
+			list = append(list, entry)
+		}
+		values["shows"] = list
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(values)
+}
@@ -0,0 +1,71 @@
+// describe.go
+//
+// Support for -describe, which prints the command-line interface as JSON so tools that
+// wrap the downloader can build their own forms without hard-coding the flag set.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io"
+	"time"
+)
+
+// flagDescription is the machine-readable form of a single command-line flag
+type flagDescription struct {
+	Name    string `json:"name"`    // Flag name without the leading dash
+	Type    string `json:"type"`    // Value type: bool, int, float, string or duration
+	Default string `json:"default"` // Default value as it would be typed on the command line
+	Usage   string `json:"usage"`   // Help text
+}
+
+// cliDescription is the document printed by -describe
+type cliDescription struct {
+	Name    string            `json:"name"`
+	Version string            `json:"version"`
+	Flags   []flagDescription `json:"flags"`
+}
+
+// flagType names the type of value a flag accepts
+func flagType(f *flag.Flag) string {
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return "string"
+	}
+
+	switch getter.Get().(type) {
+	case bool:
+		return "bool"
+	case int, int64, uint, uint64:
+		return "int"
+	case float64:
+		return "float"
+	case time.Duration:
+		return "duration"
+	default:
+		return "string"
+	}
+}
+
+// describeFlags writes a JSON description of every flag in fs to w
+func describeFlags(fs *flag.FlagSet, w io.Writer) error {
+	desc := cliDescription{
+		Name:    "wmse_downloader",
+		Version: version,
+		Flags:   []flagDescription{},
+	}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		desc.Flags = append(desc.Flags, flagDescription{
+			Name:    f.Name,
+			Type:    flagType(f),
+			Default: f.DefValue,
+			Usage:   f.Usage,
+		})
+	})
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(desc)
+}
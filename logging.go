@@ -0,0 +1,45 @@
+// logging.go
+//
+// Log level and format selection for -log-level, -quiet, -debug and -log-format. The level
+// defaults to info; -quiet keeps only warnings and errors, though the results of the run are
+// still reported since they are the program's actual output.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// logLevels lists the values accepted by -log-level
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+// parseLogLevel returns the slog level named by one of logLevels
+func parseLogLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q (want one of %s)", name, strings.Join(logLevels, ", "))
+}
+
+// newLogHandler returns a handler writing records at or above level to w in format, one of
+// logFormats
+func newLogHandler(format string, w io.Writer, level slog.Level) (slog.Handler, error) {
+	options := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "text":
+		return slog.NewTextHandler(w, options), nil
+	case "json":
+		return slog.NewJSONHandler(w, options), nil
+	}
+	return nil, fmt.Errorf("invalid -log-format %q (want one of %s)", format, strings.Join(logFormats, ", "))
+}
@@ -0,0 +1,54 @@
+// medialibrary.go
+//
+// Support for -media-library, a preset of the naming and tagging flags that suits a media
+// server. Plex gets a folder per show, like an album of dated tracks; Jellyfin gets a
+// folder per episode inside the show's, the audiobook layout, so each episode's chapters
+// are listed. Both write ID3 tags and chapters. The preset only fills in flags that were
+// not given on the command line or in the config file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// mediaLibraries lists the values accepted by -media-library
+var mediaLibraries = []string{"plex", "jellyfin"}
+
+// mediaLibraryPresets are the flag values each -media-library sets
+var mediaLibraryPresets = map[string]map[string]string{
+	"plex": {
+		"template": "{{.Show}}/{{.PlaylistDate}}_{{.Show}}.mp3",
+		"tags":     "true",
+		"chapters": "true",
+	},
+	"jellyfin": {
+		"template": "{{.Show}}/{{.PlaylistDate}}/{{.PlaylistDate}}_{{.Show}}.mp3",
+		"tags":     "true",
+		"chapters": "true",
+	},
+}
+
+// applyMediaLibrary sets each flag of the named preset in fs that has not been set already
+func applyMediaLibrary(fs *flag.FlagSet, name string) error {
+	preset, ok := mediaLibraryPresets[name]
+	if !ok {
+		return fmt.Errorf("unknown media library %q (want one of %s)", name, strings.Join(mediaLibraries, ", "))
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, flagName := range slices.Sorted(maps.Keys(preset)) {
+		if set[flagName] {
+			continue
+		}
+		if err := fs.Set(flagName, preset[flagName]); err != nil {
+			return fmt.Errorf("media library %s: %q: %w", name, flagName, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+// notify.go
+//
+// Support for -notify-done, which shows a desktop notification when a run finishes using
+// whatever notifier the platform provides: notify-send, osascript or a PowerShell toast.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// notifyTimeout bounds how long a notifier may take before it is abandoned
+const notifyTimeout = 10 * time.Second
+
+// errNoNotifier is returned when no supported notifier is installed
+var errNoNotifier = errors.New("no desktop notifier found")
+
+// notifyCommand builds the command that shows a notification on this platform
+func notifyCommand(ctx context.Context, title, message string) (*exec.Cmd, error) {
+	switch runtime.GOOS {
+	case "darwin":
+		path, err := exec.LookPath("osascript")
+		if err != nil {
+			return nil, errNoNotifier
+		}
+		quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+		script := fmt.Sprintf(`display notification "%s" with title "%s"`, quote.Replace(message), quote.Replace(title))
+		return exec.CommandContext(ctx, path, "-e", script), nil
+	case "windows":
+		path, err := exec.LookPath("powershell")
+		if err != nil {
+			return nil, errNoNotifier
+		}
+		quote := strings.NewReplacer(`'`, `''`)
+		script := fmt.Sprintf(`[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$xml = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$text = $xml.GetElementsByTagName('text')
+$text.Item(0).AppendChild($xml.CreateTextNode('%s')) > $null
+$text.Item(1).AppendChild($xml.CreateTextNode('%s')) > $null
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier('WMSE Downloader').Show([Windows.UI.Notifications.ToastNotification]::new($xml))`,
+			quote.Replace(title), quote.Replace(message))
+		return exec.CommandContext(ctx, path, "-NoProfile", "-NonInteractive", "-Command", script), nil
+	default:
+		path, err := exec.LookPath("notify-send")
+		if err != nil {
+			return nil, errNoNotifier
+		}
+		return exec.CommandContext(ctx, path, title, message), nil
+	}
+}
+
+// notifyDesktop shows a desktop notification. A missing notifier is only logged at debug
+// level, since the run itself has succeeded or failed regardless.
+func notifyDesktop(title, message string) {
+	logger := slog.Default()
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	cmd, err := notifyCommand(ctx, title, message)
+	if err != nil {
+		logger.Debug("Not sending desktop notification", "os", runtime.GOOS, "reason", err)
+		return
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		logger.Warn("Desktop notification failed",
+			"error", err,
+			"output", strings.TrimSpace(string(out)))
+	}
+}
@@ -0,0 +1,59 @@
+// outdir.go
+//
+// Checking -out before any network work. A leading ~ is expanded to the home directory,
+// the path is made absolute, and for runs that write files the directory is created and
+// tested for writing, so a bad path fails at once with a clear message.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pdfinn/wmse_downloader/wmse"
+)
+
+// expandHome replaces a leading ~ in path with the user's home directory. Other users'
+// homes (~name) are not expanded.
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") && !strings.HasPrefix(path, `~\`) {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("could not expand ~: %w", err)
+	}
+	return filepath.Join(home, path[1:]), nil
+}
+
+// prepareOutputDir returns the absolute form of dir. With create set, the directory is
+// created if needed and checked to be writable.
+func prepareOutputDir(dir string, create bool) (string, error) {
+	dir, err := expandHome(dir)
+	if err != nil {
+		return "", err
+	}
+	if dir, err = filepath.Abs(dir); err != nil {
+		return "", fmt.Errorf("could not resolve output directory: %w", err)
+	}
+	if !create {
+		return dir, nil
+	}
+
+	if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+		return "", fmt.Errorf("output path %s: %w", dir, wmse.ErrNotDirectory)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("could not create output directory: %w", err)
+	}
+
+	probe, err := os.CreateTemp(dir, ".wmse-write-test-*")
+	if err != nil {
+		return "", fmt.Errorf("output directory %s is not writable: %w", dir, err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return dir, nil
+}
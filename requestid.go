@@ -0,0 +1,68 @@
+// requestid.go
+//
+// Support for -request-id-header, which sends a fresh UUID with every HTTP request and
+// logs it, so a flaky download can be matched up with the server's own logs. The ID is also
+// handed back through the request's context, so the downloader's records of retries,
+// failures and completed downloads carry it too.
+
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/pdfinn/wmse_downloader/wmse"
+)
+
+// requestIDTransport adds a unique ID header to each request it sends
+type requestIDTransport struct {
+	header string
+	base   http.RoundTripper
+}
+
+// RoundTrip tags req with a new ID and logs the exchange under it
+func (t *requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	logger := slog.Default()
+	id := newUUID()
+
+	// RoundTrippers must not modify the caller's request
+	req = req.Clone(req.Context())
+	req.Header.Set(t.header, id)
+	wmse.SetRequestID(req.Context(), id)
+
+	logger.Debug("Sending request",
+		"request_id", id,
+		"method", req.Method,
+		"url", req.URL.String())
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		logger.Warn("Request failed",
+			"request_id", id,
+			"url", req.URL.String(),
+			"error", err)
+		return nil, err
+	}
+
+	level := slog.LevelDebug
+	if resp.StatusCode >= 400 {
+		level = slog.LevelWarn
+	}
+	logger.Log(req.Context(), level, "Received response",
+		"request_id", id,
+		"url", req.URL.String(),
+		"status", resp.Status)
+
+	return resp, nil
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
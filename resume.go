@@ -0,0 +1,84 @@
+// resume.go
+//
+// Support for -resume, which lets an interrupted run of several shows carry on where it
+// stopped. As each show finishes without failures it is listed in .wmse-run.json in -out;
+// a later run of the same shows with -resume skips those without listing their archives
+// again, and the download state file skips the episodes the interrupted show had already
+// saved. The file is removed once a run gets through every show.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/pdfinn/wmse_downloader/wmse"
+)
+
+// runProgressFile is the name of the run progress file in the output directory
+const runProgressFile = ".wmse-run.json"
+
+// runProgress is the shows of a run and those already finished
+type runProgress struct {
+	path  string
+	Shows []string `json:"shows"`
+	Done  []string `json:"done"`
+}
+
+// newRunProgress starts recording the progress of a run of shows in dir. With resume set,
+// the shows finished by an earlier run of the same shows are kept; a run of other shows
+// starts afresh.
+func newRunProgress(dir string, shows []string, resume bool) (*runProgress, error) {
+	p := &runProgress{path: filepath.Join(dir, runProgressFile), Shows: shows}
+	if !resume {
+		return p, nil
+	}
+
+	data, err := os.ReadFile(p.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read run progress: %w", err)
+	}
+	var earlier runProgress
+	if err := json.Unmarshal(data, &earlier); err != nil {
+		return nil, fmt.Errorf("could not parse run progress %s: %w", p.path, err)
+	}
+	if !slices.Equal(earlier.Shows, shows) {
+		slog.Default().Warn("Not resuming: the interrupted run was of other shows",
+			"path", p.path,
+			"shows", strings.Join(earlier.Shows, ","))
+		return p, nil
+	}
+	p.Done = earlier.Done
+	return p, nil
+}
+
+// done reports whether show was finished by the run being resumed
+func (p *runProgress) done(show string) bool {
+	return slices.Contains(p.Done, show)
+}
+
+// markDone records that show has finished and saves the progress file
+func (p *runProgress) markDone(show string) error {
+	p.Done = append(p.Done, show)
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return wmse.WriteFileAtomic(p.path, data, 0644)
+}
+
+// finish removes the progress file once every show has been through the run
+func (p *runProgress) finish() error {
+	if err := os.Remove(p.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+// shows.go
+//
+// Running the pipeline for each show named with -show. Several shows can be given as a
+// comma-separated list; each is looked up and downloaded in turn, and a show whose archive
+// list cannot be fetched is reported without stopping the others.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pdfinn/wmse_downloader/wmse"
+)
+
+// lookupTimeout bounds the requests that find one show's archive list
+const lookupTimeout = 30 * time.Minute
+
+// selection is how the archives of a show are found and narrowed down
+type selection struct {
+	ArchivesFile    string // Saved archive list to use instead of the API
+	ArchiveID       string // Known archive ID, so the program page is not needed
+	StartIndex      int
+	EndIndex        int
+	Limit           int
+	Order           string
+	SinceLastRun    bool // Keep only archives newer than the newest one already downloaded
+	AllowDuplicates bool // Keep archives that repeat an earlier archive's URL
+}
+
+// showSetup is the downloader and selection used for one show
+type showSetup struct {
+	d   *wmse.Downloader
+	sel selection
+	out string // The show's output directory
+}
+
+// showRun is what happened to one show
+type showRun struct {
+	Show     string
+	Archives []wmse.Archive
+	Outcomes []wmse.Outcome
+	Err      error // Why the show's archives could not be listed, if they couldn't
+}
+
+// parseShows splits a -show value into show IDs, dropping blanks and repeats
+func parseShows(value string) []string {
+	var shows []string
+	seen := make(map[string]bool)
+	for _, show := range strings.Split(value, ",") {
+		show = strings.TrimSpace(show)
+		if show != "" && !seen[show] {
+			seen[show] = true
+			shows = append(shows, show)
+		}
+	}
+	return shows
+}
+
+// resolveArchives finds the archives of show, applies the filters of sel and puts them in
+// its order, then takes its range and limit
+func resolveArchives(ctx context.Context, d *wmse.Downloader, show string, sel selection, savePage bool) ([]wmse.Archive, error) {
+	archives, err := listArchives(ctx, d, show, sel, savePage)
+	if err != nil {
+		return nil, err
+	}
+	return selectArchives(d, show, archives, sel)
+}
+
+// listArchives finds every archive of show, from the source sel names, dropping repeated
+// URLs unless sel allows them
+func listArchives(ctx context.Context, d *wmse.Downloader, show string, sel selection, savePage bool) ([]wmse.Archive, error) {
+	logger := slog.Default()
+	ctx, cancel := context.WithTimeout(ctx, lookupTimeout)
+	defer cancel()
+
+	var archives []wmse.Archive
+	var err error
+	if sel.ArchivesFile != "" {
+		// Use a saved archive list instead of asking the API
+		archives, err = d.LoadArchives(sel.ArchivesFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load archives file: %w", err)
+		}
+		if savePage {
+			logger.Warn("Not saving program page: no page is fetched when using -archives-file")
+		}
+	} else {
+		archiveID := sel.ArchiveID
+		if archiveID != "" {
+			// A known archive ID makes the program page unnecessary
+			if err := wmse.ValidateArchiveID(archiveID); err != nil {
+				return nil, fmt.Errorf("invalid -archive-id: %w", err)
+			}
+			logger.Info("Using archive ID from command line", "id", archiveID)
+			if savePage {
+				logger.Warn("Not saving program page: no page is fetched when using -archive-id")
+			}
+		} else {
+			// First get the archive ID from the program page
+			archiveID, err = d.ArchiveID(ctx, show)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get archive ID: %w", err)
+			}
+		}
+
+		// Then fetch archives from the API
+		archives, err = d.Archives(ctx, archiveID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch archives: %w", err)
+		}
+	}
+
+	if len(archives) == 0 {
+		return nil, errors.New("no archives found")
+	}
+
+	if !sel.AllowDuplicates {
+		var duplicates []wmse.Archive
+		archives, duplicates = wmse.DedupeArchives(archives)
+		for _, archive := range duplicates {
+			logger.Info("Skipping archive with a duplicate URL",
+				"show_id", show,
+				"date", archive.PlaylistDate,
+				"url", archive.ArchiveURL)
+		}
+	}
+	return archives, nil
+}
+
+// selectArchives applies the filters of sel to the archives of show and puts them in its
+// order, then takes its range and limit
+func selectArchives(d *wmse.Downloader, show string, archives []wmse.Archive, sel selection) ([]wmse.Archive, error) {
+	logger := slog.Default()
+	var err error
+	if sel.SinceLastRun {
+		total := len(archives)
+		if cutoff, ok := d.LastDownloaded(archives); ok {
+			archives = wmse.ArchivesAfter(archives, cutoff)
+			logger.Info("Downloading only archives newer than the last run",
+				"show_id", show,
+				"cutoff", cutoff.Format(time.RFC3339),
+				"count", len(archives),
+				"total", total)
+		} else {
+			logger.Info("No archives downloaded yet, so -since-last-run keeps them all",
+				"show_id", show,
+				"total", total)
+		}
+	}
+
+	// Sort first, so -start-index and -end-index count in the order downloads happen
+	if archives, err = wmse.SortArchives(archives, sel.Order); err != nil {
+		return nil, err
+	}
+
+	if sel.StartIndex != 0 || sel.EndIndex != 0 {
+		total := len(archives)
+		archives, err = wmse.SliceArchives(archives, sel.StartIndex, sel.EndIndex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid archive range for %d archives: %w", total, err)
+		}
+		logger.Info("Selected archive range",
+			"show_id", show,
+			"start", sel.StartIndex,
+			"count", len(archives),
+			"total", total)
+	}
+
+	if sel.Limit > 0 {
+		total := len(archives)
+		// LimitArchives returns newest first, so the chosen order is put back
+		if archives, err = wmse.SortArchives(wmse.LimitArchives(archives, sel.Limit), sel.Order); err != nil {
+			return nil, err
+		}
+		logger.Info("Limited to most recent archives",
+			"show_id", show,
+			"count", len(archives),
+			"total", total)
+	}
+
+	return archives, nil
+}
+
+// onlyChanged writes the archives of show that are new or have changed upstream since they
+// were downloaded to w as JSON, for -only-if-changed, and returns just those. The changed
+// ones will be downloaded again.
+func onlyChanged(ctx context.Context, d *wmse.Downloader, show string, archives []wmse.Archive, w io.Writer) ([]wmse.Archive, error) {
+	changes := d.Changes(ctx, archives)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(changes); err != nil {
+		return nil, err
+	}
+
+	var kept, replaced []wmse.Archive
+	for _, change := range changes {
+		kept = append(kept, change.Archive)
+		if change.Change != wmse.ChangeNew {
+			replaced = append(replaced, change.Archive)
+		}
+	}
+	d.Replace(replaced)
+	slog.Default().Info("Keeping only new and changed archives",
+		"show_id", show,
+		"new", len(kept)-len(replaced),
+		"changed", len(replaced),
+		"total", len(archives))
+	return kept, nil
+}
+
+// resumePartials downloads the archives of shows whose downloads were left unfinished in
+// their output directories, for -resume-all. It returns what happened to each show with
+// partials, and the full archive list of each show it listed, so it is not fetched again.
+func resumePartials(ctx context.Context, shows []string, setups map[string]showSetup, savePage bool) (resumed map[string]showRun, listed map[string][]wmse.Archive, err error) {
+	logger := slog.Default()
+	resumed = make(map[string]showRun)
+	listed = make(map[string][]wmse.Archive)
+
+	partials := make(map[string]bool)
+	searched := make(map[string]bool)
+	for _, show := range shows {
+		dir := setups[show].out
+		if searched[dir] {
+			continue
+		}
+		searched[dir] = true
+		found, err := wmse.FindPartials(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, path := range found {
+			partials[path] = true
+		}
+	}
+	if len(partials) == 0 {
+		logger.Info("No unfinished downloads to resume")
+		return resumed, listed, nil
+	}
+
+	for _, show := range shows {
+		if len(partials) == 0 || ctx.Err() != nil {
+			break
+		}
+		setup := setups[show]
+		archives, err := listArchives(ctx, setup.d, show, setup.sel, savePage)
+		if err != nil {
+			// The normal pass lists the show again and reports the failure
+			continue
+		}
+		listed[show] = archives
+
+		found := setup.d.PartialArchives(archives, partials)
+		if len(found) == 0 {
+			continue
+		}
+		logger.Info("Resuming unfinished downloads", "show_id", show, "count", len(found))
+		resumed[show] = showRun{Show: show, Archives: found, Outcomes: setup.d.DownloadAll(ctx, found)}
+	}
+
+	if ctx.Err() == nil {
+		for _, path := range slices.Sorted(maps.Keys(partials)) {
+			logger.Warn("Unfinished download matches no archive of the shows in this run", "path", path)
+		}
+	}
+	return resumed, listed, nil
+}
+
+// withoutArchives returns archives less any that are also in exclude
+func withoutArchives(archives, exclude []wmse.Archive) []wmse.Archive {
+	key := func(a wmse.Archive) string { return a.ShowID + "\x00" + a.PlaylistDate + "\x00" + a.ArchiveURL }
+	skip := make(map[string]bool)
+	for _, archive := range exclude {
+		skip[key(archive)] = true
+	}
+	var kept []wmse.Archive
+	for _, archive := range archives {
+		if !skip[key(archive)] {
+			kept = append(kept, archive)
+		}
+	}
+	return kept
+}
+
+// tally counts the outcomes of a show's downloads, returning the paths downloaded in this
+// run along with the number skipped and failed
+func (r showRun) tally() (downloaded map[string]bool, skipped, failed int) {
+	downloaded = make(map[string]bool)
+	for _, outcome := range r.Outcomes {
+		switch {
+		case outcome.Err != nil:
+			if !outcome.Benign {
+				failed++
+			}
+		case outcome.Skipped:
+			skipped++
+		default:
+			downloaded[outcome.Path] = true
+		}
+	}
+	return downloaded, skipped, failed
+}
+
+// runStats totals the archives of every show in a run, for the closing summary
+type runStats struct {
+	started    time.Time
+	archives   int   // Archives selected for download
+	downloaded int   // Files downloaded in this run
+	skipped    int   // Archives already present
+	failed     int   // Failed downloads, and shows whose archives could not be listed
+	bytes      int64 // Size of the files downloaded in this run
+}
+
+// add counts the archives and outcomes of run, returning its tally
+func (s *runStats) add(run showRun) (downloaded map[string]bool, skipped, failed int) {
+	downloaded, skipped, failed = run.tally()
+	s.archives += len(run.Archives)
+	s.downloaded += len(downloaded)
+	s.skipped += skipped
+	s.failed += failed
+	for _, outcome := range run.Outcomes {
+		if outcome.Err == nil && !outcome.Skipped {
+			s.bytes += outcome.Bytes
+		}
+	}
+	return downloaded, skipped, failed
+}
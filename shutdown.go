@@ -0,0 +1,46 @@
+// shutdown.go
+//
+// Graceful shutdown on Ctrl-C. The first interrupt cancels the run's context, so downloads
+// in progress stop, keeping their temporary files for the next run to resume, and no new
+// ones start; a second interrupt exits straight away.
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// interruptedExitCode is the conventional exit status after SIGINT
+const interruptedExitCode = 130
+
+// interruptContext returns a context that is cancelled by the first SIGINT or SIGTERM.
+// A second signal exits the process immediately.
+func interruptContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			slog.Default().Warn("Interrupted, stopping downloads; interrupt again to exit immediately",
+				"signal", sig)
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+
+		<-signals
+		slog.Default().Error("Interrupted again, exiting")
+		os.Exit(interruptedExitCode)
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
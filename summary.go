@@ -0,0 +1,116 @@
+// summary.go
+//
+// Support for -log-format=json. Logs are written to stderr as JSON lines, and once the run
+// is over a single JSON document describing what happened to each archive is written to
+// stdout, so scripts can read the outcome without scraping log messages.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/pdfinn/wmse_downloader/wmse"
+)
+
+// logFormats lists the values accepted by -log-format
+var logFormats = []string{"text", "json"}
+
+// archiveSummary is the outcome of one archive in the run summary
+type archiveSummary struct {
+	ShowID       string `json:"show_id"`
+	PlaylistDate string `json:"playlist_date"`
+	Path         string `json:"path,omitempty"`
+	Status       string `json:"status"` // downloaded, skipped, pending or failed
+	Success      bool   `json:"success"`
+	Bytes        int64  `json:"bytes"`
+	Retries      int    `json:"retries"`
+	Error        string `json:"error,omitempty"`
+}
+
+// runSummary is the outcome of one show, and the document written to stdout at the end of
+// a run for a single show
+type runSummary struct {
+	Show       string           `json:"show"`
+	Error      string           `json:"error,omitempty"` // Why the show's archives could not be listed
+	Downloaded int              `json:"downloaded"`
+	Skipped    int              `json:"skipped"`
+	Pending    int              `json:"pending"`
+	Failed     int              `json:"failed"`
+	Archives   []archiveSummary `json:"archives"`
+}
+
+// multiShowSummary is the document written to stdout at the end of a run for several shows
+type multiShowSummary struct {
+	Downloaded  int          `json:"downloaded"`
+	Skipped     int          `json:"skipped"`
+	Pending     int          `json:"pending"`
+	Failed      int          `json:"failed"`
+	FailedShows int          `json:"failed_shows"` // Shows whose archives could not be listed
+	Shows       []runSummary `json:"shows"`
+}
+
+// summarizeRun builds the run summary from the outcome of each archive
+func summarizeRun(showID string, archives []wmse.Archive, outcomes []wmse.Outcome) runSummary {
+	summary := runSummary{Show: showID, Archives: make([]archiveSummary, 0, len(archives))}
+	for i, archive := range archives {
+		outcome := outcomes[i]
+		entry := archiveSummary{
+			ShowID:       archive.ShowID,
+			PlaylistDate: archive.PlaylistDate,
+			Path:         outcome.Path,
+			Bytes:        outcome.Bytes,
+			Retries:      outcome.Retries,
+		}
+
+		switch {
+		case outcome.Err != nil && outcome.Benign:
+			entry.Status, entry.Success = "pending", true
+			summary.Pending++
+		case outcome.Err != nil:
+			entry.Status = "failed"
+			summary.Failed++
+		case outcome.Skipped:
+			entry.Status, entry.Success = "skipped", true
+			summary.Skipped++
+		default:
+			entry.Status, entry.Success = "downloaded", true
+			summary.Downloaded++
+		}
+		if outcome.Err != nil {
+			entry.Error = outcome.Err.Error()
+		}
+
+		summary.Archives = append(summary.Archives, entry)
+	}
+	return summary
+}
+
+// summarizeShows builds the document for a run: the show's own summary if there was one,
+// or the summaries of every show grouped under run totals
+func summarizeShows(runs []showRun) any {
+	var multi multiShowSummary
+	for _, run := range runs {
+		summary := summarizeRun(run.Show, run.Archives, run.Outcomes)
+		if run.Err != nil {
+			summary.Error = run.Err.Error()
+			multi.FailedShows++
+		}
+		if len(runs) == 1 {
+			return summary
+		}
+		multi.Downloaded += summary.Downloaded
+		multi.Skipped += summary.Skipped
+		multi.Pending += summary.Pending
+		multi.Failed += summary.Failed
+		multi.Shows = append(multi.Shows, summary)
+	}
+	return multi
+}
+
+// writeSummary writes summary to w as indented JSON
+func writeSummary(w io.Writer, summary any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(summary)
+}
@@ -0,0 +1,88 @@
+// archivecache.go
+//
+// A short-lived on-disk cache of archive lists. When a run is interrupted after the list
+// was fetched, a quick re-run reads it from the cache instead of calling the API again.
+
+package wmse
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// defaultArchiveCacheTTL is how long a cached archive list is reused
+const defaultArchiveCacheTTL = 15 * time.Minute
+
+// archiveCachePath returns where the archive list for archiveID from api is cached. Lists
+// from an API other than the default are kept apart so they never mix.
+func archiveCachePath(api, archiveID string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	name := "archives_" + archiveID + ".json"
+	if api != defaultAPIURL {
+		sum := sha256.Sum256([]byte(api))
+		name = "archives_" + hex.EncodeToString(sum[:4]) + "_" + archiveID + ".json"
+	}
+	return filepath.Join(dir, "wmse_downloader", name), nil
+}
+
+// fetchArchivesCached returns the archive list for archiveID, from the cache if it was
+// saved less than ttl ago, otherwise from the API. A ttl of 0 disables the cache; refresh
+// ignores any cached copy but still saves the new list.
+func fetchArchivesCached(ctx context.Context, client HTTPClient, api, archiveID string, ttl time.Duration, refresh bool) ([]Archive, error) {
+	logger := slog.Default()
+	if ttl <= 0 {
+		return fetchArchives(ctx, client, api, archiveID)
+	}
+
+	path, err := archiveCachePath(api, archiveID)
+	if err != nil {
+		logger.Debug("Archive list cache unavailable", "error", err)
+		return fetchArchives(ctx, client, api, archiveID)
+	}
+
+	if info, err := os.Stat(path); err == nil && !refresh {
+		if age := time.Since(info.ModTime()); age < ttl {
+			archives, err := loadArchivesFile(path)
+			if err == nil {
+				logger.Info("Using cached archive list (pass -refresh to fetch it again)",
+					"archive_id", archiveID,
+					"age", age.Round(time.Second))
+				return archives, nil
+			}
+			logger.Warn("Ignoring unreadable archive list cache", "path", path, "error", err)
+		}
+	}
+
+	archives, err := fetchArchives(ctx, client, api, archiveID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := saveArchiveCache(path, archives); err != nil {
+		logger.Warn("Failed to cache archive list", "path", path, "error", err)
+	}
+
+	return archives, nil
+}
+
+// saveArchiveCache writes archives to path in the API's JSON format
+func saveArchiveCache(path string, archives []Archive) error {
+	data, err := json.Marshal(archives)
+	if err != nil {
+		return fmt.Errorf("failed to encode archive list: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0644)
+}
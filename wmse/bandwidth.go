@@ -0,0 +1,103 @@
+// bandwidth.go
+//
+// Support for -max-bandwidth, which caps how fast archives are downloaded. A single token
+// bucket is shared by every download, so parallel workers split the limit between them
+// rather than each getting the full amount.
+
+package wmse
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// byteUnits are the suffixes accepted by ParseByteSize, longest first so "MB" is not read as "B"
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30},
+	{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+	{"k", 1 << 10}, {"m", 1 << 20}, {"g", 1 << 30},
+	{"b", 1},
+}
+
+// ParseByteSize reads a size such as "512K", "2MB" or "1.5GiB". Units are powers of 1024
+// and a bare number is a count of bytes.
+func ParseByteSize(s string) (int64, error) {
+	value := strings.ToLower(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// bandwidthLimiter is a token bucket refilled at a fixed number of bytes per second
+type bandwidthLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes per second
+	burst  float64 // Most tokens the bucket holds
+	tokens float64
+	last   time.Time
+}
+
+// newBandwidthLimiter returns a limiter allowing bytesPerSecond, with up to one second's
+// worth of data let through in a burst
+func newBandwidthLimiter(bytesPerSecond int64) *bandwidthLimiter {
+	rate := float64(bytesPerSecond)
+	return &bandwidthLimiter{rate: rate, burst: rate, tokens: rate, last: time.Now()}
+}
+
+// wait takes n bytes from the bucket, sleeping until the bucket can cover them. Callers
+// queue fairly: each reservation is taken in turn even if it drives the bucket negative.
+func (l *bandwidthLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	var pause time.Duration
+	if l.tokens < 0 {
+		pause = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	time.Sleep(pause)
+}
+
+// chunk returns the largest read that should be made at once, so one read never needs
+// more than the bucket can hold
+func (l *bandwidthLimiter) chunk() int {
+	return max(1, int(l.burst))
+}
+
+// rateLimitedReader passes reads through a bandwidthLimiter
+type rateLimitedReader struct {
+	reader  io.Reader
+	limiter *bandwidthLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > r.limiter.chunk() {
+		p = p[:r.limiter.chunk()]
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.limiter.wait(n)
+	}
+	return n, err
+}
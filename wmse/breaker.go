@@ -0,0 +1,98 @@
+// breaker.go
+//
+// A circuit breaker for downloads. When the CDN fails every request, retrying archive after
+// archive only wastes time, so after a run of consecutive server, network or timeout
+// failures all downloads pause for a cooldown, which doubles each time the breaker trips
+// again. If failures carry on through several cooldowns the rest of the run is abandoned.
+
+package wmse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultBreakerFailures is how many failures in a row trip the breaker
+	defaultBreakerFailures = 5
+	// defaultBreakerCooldown is the first pause after the breaker trips
+	defaultBreakerCooldown = 2 * time.Minute
+	// defaultBreakerMaxCooldowns is how many pauses are tried before giving up
+	defaultBreakerMaxCooldowns = 3
+)
+
+// ErrCircuitOpen is returned for downloads not attempted because the breaker gave up
+var ErrCircuitOpen = errors.New("too many consecutive download failures")
+
+// circuitBreaker pauses and eventually stops downloads after repeated failures. It is shared
+// by every worker of a run.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int           // Consecutive failures that trip the breaker
+	cooldown  time.Duration // Pause after the first trip; doubled for each later one
+	maxTrips  int           // Cooldowns allowed before giving up
+	failures  int
+	trips     int
+	until     time.Time // End of the current cooldown
+	open      bool      // Given up for the rest of the run
+}
+
+// newCircuitBreaker returns a breaker tripping after threshold consecutive failures
+func newCircuitBreaker(threshold int, cooldown time.Duration, maxTrips int) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, maxTrips: maxTrips}
+}
+
+// wait blocks while a cooldown is in progress. It returns ErrCircuitOpen once the breaker
+// has given up, or ctx's error if ctx ends first.
+func (b *circuitBreaker) wait(ctx context.Context) error {
+	b.mu.Lock()
+	open, until := b.open, b.until
+	b.mu.Unlock()
+
+	if open {
+		return ErrCircuitOpen
+	}
+	return sleepContext(ctx, time.Until(until))
+}
+
+// record counts the outcome of a download. Only failures that suggest the server is in
+// trouble count; a success closes the breaker again.
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		b.failures, b.trips = 0, 0
+		return
+	}
+	switch classifyError(err) {
+	case errorClassServer, errorClassNetwork, errorClassTimeout:
+	default:
+		return
+	}
+
+	b.failures++
+	if b.failures < b.threshold || b.open || time.Now().Before(b.until) {
+		return
+	}
+
+	logger := slog.Default()
+	b.failures = 0
+	b.trips++
+	if b.trips > b.maxTrips {
+		b.open = true
+		logger.Error("Downloads kept failing after every cooldown; giving up on the rest of the run",
+			"cooldowns", b.maxTrips)
+		return
+	}
+	pause := b.cooldown << (b.trips - 1)
+	b.until = time.Now().Add(pause)
+	logger.Warn("Too many consecutive download failures; pausing downloads",
+		"failures", b.threshold,
+		"cooldown", pause,
+		"cooldown_number", fmt.Sprintf("%d/%d", b.trips, b.maxTrips))
+}
@@ -0,0 +1,83 @@
+// changes.go
+//
+// Support for -only-if-changed, which compares the archive list with the download state
+// file and keeps only the episodes that are new or have changed upstream since they were
+// downloaded: a different archive URL, or a different size on the server. Entries recorded
+// before the state file kept the URL and size can only be told apart from new ones.
+
+package wmse
+
+import (
+	"context"
+	"log/slog"
+)
+
+// The kinds of ArchiveChange
+const (
+	ChangeNew  = "new"  // Never downloaded
+	ChangeURL  = "url"  // The archive URL differs from the one downloaded
+	ChangeSize = "size" // The server's copy has a different size from the one downloaded
+)
+
+// ArchiveChange is an archive that is new or has changed since it was downloaded
+type ArchiveChange struct {
+	Archive      Archive `json:"-"`
+	ShowID       string  `json:"show_id"`
+	PlaylistDate string  `json:"playlist_date"`
+	Change       string  `json:"change"` // One of ChangeNew, ChangeURL or ChangeSize
+	ArchiveURL   string  `json:"archive_url"`
+	PreviousURL  string  `json:"previous_url,omitempty"`
+	RemoteSize   int64   `json:"remote_size,omitempty"`
+	PreviousSize int64   `json:"previous_size,omitempty"`
+}
+
+// archiveChanges compares archives with the state file. The size of each archive downloaded
+// from an unchanged URL is asked of the server; if it cannot be, the archive counts as unchanged.
+func archiveChanges(ctx context.Context, archives []Archive, opts downloadOptions) []ArchiveChange {
+	logger := slog.Default()
+
+	changes := []ArchiveChange{}
+	for _, archive := range archives {
+		if ctx.Err() != nil {
+			break
+		}
+		change := ArchiveChange{
+			Archive:      archive,
+			ShowID:       archive.ShowID,
+			PlaylistDate: archive.PlaylistDate,
+			ArchiveURL:   archive.ArchiveURL,
+		}
+
+		var entry stateEntry
+		var ok bool
+		if opts.State != nil {
+			entry, ok = opts.State.lookup(archive)
+		}
+		switch {
+		case !ok:
+			change.Change = ChangeNew
+		case entry.URL != "" && entry.URL != archive.ArchiveURL:
+			change.Change = ChangeURL
+			change.PreviousURL = entry.URL
+		case entry.RemoteSize > 0:
+			size, _, err := headArchive(ctx, opts.apiClient(), archive.ArchiveURL)
+			if err != nil {
+				logger.Warn("Could not check archive for changes",
+					"archive", archive.ShowID,
+					"date", archive.PlaylistDate,
+					"error", err)
+				continue
+			}
+			if size < 0 || size == entry.RemoteSize {
+				continue
+			}
+			change.Change = ChangeSize
+			change.RemoteSize = size
+			change.PreviousSize = entry.RemoteSize
+		default:
+			continue
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
@@ -0,0 +1,165 @@
+// chapters.go
+//
+// Support for -chapters, which embeds the playlist as ID3v2 CHAP frames, with a CTOC frame
+// listing them, so players can jump between songs. Chapters need a start time for every
+// track; playlists without them are left as a plain tracklist and the download carries on.
+
+package wmse
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// errNoTrackTimes is returned when a playlist does not say when its tracks were played
+var errNoTrackTimes = errors.New("playlist has no track start times")
+
+// trackTimeFields are the track fields that may hold a start time, in order of preference:
+// an offset into the show, in seconds or as [hh:]mm:ss, or the time the track was played
+var trackTimeFields = []string{"offset", "start", "start_time", "played_at", "timestamp", "time"}
+
+// trackTimeLayouts are the layouts of track times given as a date and time
+var trackTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05"}
+
+// maxChapters is the most chapters a CTOC frame can list, as its entry count is one byte
+const maxChapters = 255
+
+// chapter is one track's span of the recording
+type chapter struct {
+	start, end time.Duration
+	title      string
+}
+
+// parseTrackTime reads a start time field. Offsets are returned as a duration; absolute
+// times are returned as a time, for measuring against the first track.
+func parseTrackTime(value string) (offset time.Duration, at time.Time, ok bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, time.Time{}, false
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds >= 0 {
+		return time.Duration(seconds * float64(time.Second)), time.Time{}, true
+	}
+	if parts := strings.Split(value, ":"); len(parts) == 2 || len(parts) == 3 {
+		var total time.Duration
+		valid := true
+		for _, part := range parts {
+			n, err := strconv.ParseFloat(part, 64)
+			if err != nil || n < 0 {
+				valid = false
+				break
+			}
+			total = total*60 + time.Duration(n*float64(time.Second))
+		}
+		if valid {
+			return total, time.Time{}, true
+		}
+	}
+	for _, layout := range trackTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return 0, t, true
+		}
+	}
+	return 0, time.Time{}, false
+}
+
+// trackStarts returns when each track starts, measured from the start of the recording.
+// Every track must have a time in the same field and the times must not go backwards.
+func trackStarts(tracks []Track) ([]time.Duration, error) {
+	if len(tracks) == 0 {
+		return nil, errNoTrackTimes
+	}
+	for _, field := range trackTimeFields {
+		if _, ok := tracks[0][field]; !ok {
+			continue
+		}
+
+		starts := make([]time.Duration, 0, len(tracks))
+		var first time.Time
+		for i, track := range tracks {
+			offset, at, ok := parseTrackTime(track[field])
+			if !ok {
+				return nil, fmt.Errorf("%w: track %d has no usable %q", errNoTrackTimes, i+1, field)
+			}
+			if !at.IsZero() {
+				if i == 0 {
+					first = at
+				} else if first.IsZero() {
+					return nil, fmt.Errorf("%w: %q mixes offsets and times", errNoTrackTimes, field)
+				}
+				offset = at.Sub(first)
+			}
+			if i > 0 && offset < starts[i-1] {
+				return nil, fmt.Errorf("%w: %q goes backwards at track %d", errNoTrackTimes, field, i+1)
+			}
+			starts = append(starts, offset)
+		}
+		return starts, nil
+	}
+	return nil, errNoTrackTimes
+}
+
+// playlistChapters turns the tracks into chapters titled with tmpl. Each chapter ends where
+// the next begins and the last ends at length, the playing time of the recording.
+func playlistChapters(tracks []Track, tmpl *template.Template, length time.Duration) ([]chapter, error) {
+	starts, err := trackStarts(tracks)
+	if err != nil {
+		return nil, err
+	}
+	if len(tracks) > maxChapters {
+		return nil, fmt.Errorf("playlist has %d tracks, more than the %d chapters ID3 allows", len(tracks), maxChapters)
+	}
+
+	chapters := make([]chapter, len(tracks))
+	for i, track := range tracks {
+		var sb strings.Builder
+		if err := tmpl.Execute(&sb, track); err != nil {
+			return nil, fmt.Errorf("failed to render chapter title: %w", err)
+		}
+		end := max(length, starts[i])
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		chapters[i] = chapter{start: starts[i], end: end, title: sb.String()}
+	}
+	return chapters, nil
+}
+
+// outputChapters returns the chapters of the MP3 at path. If its playing time cannot be
+// worked out, the last chapter ends where it starts.
+func outputChapters(path string, tracks []Track, tmpl *template.Template) ([]chapter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	length, _ := mp3Duration(f)
+	f.Close()
+	return playlistChapters(tracks, tmpl, length)
+}
+
+// chapterFrames builds a CHAP frame for each chapter and a CTOC frame listing them in order
+func chapterFrames(chapters []chapter) []id3Frame {
+	frames := make([]id3Frame, 0, len(chapters)+1)
+	toc := []byte("toc\x00")
+	toc = append(toc, 0x03, byte(len(chapters))) // Top level, ordered
+	for i, ch := range chapters {
+		id := fmt.Sprintf("chp%d", i+1)
+		toc = append(toc, id...)
+		toc = append(toc, 0)
+
+		data := append([]byte(id), 0)
+		data = binary.BigEndian.AppendUint32(data, uint32(ch.start.Milliseconds()))
+		data = binary.BigEndian.AppendUint32(data, uint32(ch.end.Milliseconds()))
+		data = binary.BigEndian.AppendUint32(data, 0xffffffff) // No byte offsets
+		data = binary.BigEndian.AppendUint32(data, 0xffffffff)
+		data = append(data, encodeID3Frames([]id3Frame{id3TextFrame("TIT2", ch.title)})...)
+		frames = append(frames, id3Frame{id: "CHAP", data: data})
+	}
+	return append([]id3Frame{{id: "CTOC", data: toc}}, frames...)
+}
@@ -0,0 +1,146 @@
+// checksums.go
+//
+// The checksum manifest. Every completed download appends a "filename  sha256" line to
+// checksums.txt in the output directory, and -verify reads the manifest back, re-hashing
+// each file to report any that have been corrupted or removed since.
+
+package wmse
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// checksumsFile is the name of the manifest in the output directory
+const checksumsFile = "checksums.txt"
+
+// checksumLog appends entries to an output directory's manifest
+type checksumLog struct {
+	mu  sync.Mutex
+	dir string
+}
+
+// newChecksumLog returns a log for the manifest in dir
+func newChecksumLog(dir string) *checksumLog {
+	return &checksumLog{dir: dir}
+}
+
+// record appends the hash of the file at path, which must be under the log's directory
+func (l *checksumLog) record(path, sum string) error {
+	rel, err := filepath.Rel(l.dir, path)
+	if err != nil {
+		return err
+	}
+	line := fmt.Sprintf("%s  %s\n", filepath.ToSlash(rel), sum)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := os.OpenFile(filepath.Join(l.dir, checksumsFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// forget rewrites the manifest without the entries for paths, after they were deleted
+func (l *checksumLog) forget(paths []string) error {
+	drop := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		if rel, err := filepath.Rel(l.dir, path); err == nil {
+			drop[filepath.ToSlash(rel)] = true
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	manifest := filepath.Join(l.dir, checksumsFile)
+	data, err := os.ReadFile(manifest)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var kept strings.Builder
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		i := strings.LastIndex(line, "  ")
+		if i > 0 && drop[line[:i]] {
+			continue
+		}
+		kept.WriteString(line)
+	}
+	return writeFileAtomic(manifest, []byte(kept.String()), 0644)
+}
+
+// readChecksums reads the manifest in dir and returns the hash of each file, keyed by its
+// slash-separated path relative to dir. A file listed more than once keeps its last entry.
+func readChecksums(dir string) (map[string]string, error) {
+	f, err := os.Open(filepath.Join(dir, checksumsFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		// Names may contain spaces, so split at the last separator
+		i := strings.LastIndex(text, "  ")
+		if i <= 0 {
+			return nil, fmt.Errorf("%s line %d: expected \"filename  sha256\"", checksumsFile, line)
+		}
+		sums[text[:i]] = strings.ToLower(strings.TrimSpace(text[i+2:]))
+	}
+	return sums, scanner.Err()
+}
+
+// verifyChecksums re-hashes every file in dir's manifest using up to concurrency workers
+// and logs each one that is missing or no longer matches. It returns the number of files
+// that failed.
+func verifyChecksums(dir string, concurrency int) (int, error) {
+	logger := slog.Default()
+	sums, err := readChecksums(dir)
+	if err != nil {
+		return 0, fmt.Errorf("could not read checksum manifest: %w", err)
+	}
+
+	start := time.Now()
+	mismatches := checkHashes(sums, func(name string) string {
+		return filepath.Join(dir, filepath.FromSlash(name))
+	}, concurrency)
+	for _, m := range mismatches {
+		switch {
+		case errors.Is(m.err, os.ErrNotExist):
+			logger.Error("File is missing", "path", m.path)
+		case m.err != nil:
+			logger.Error("Could not verify file", "path", m.path, "error", m.err)
+		default:
+			logger.Error("File is corrupted",
+				"path", m.path,
+				"expected_sha256", m.expected,
+				"actual_sha256", m.actual)
+		}
+	}
+
+	logger.Info("Checksum verification complete",
+		"files", len(sums),
+		"failed", len(mismatches),
+		"elapsed", time.Since(start).Round(time.Millisecond))
+
+	return len(mismatches), nil
+}
@@ -0,0 +1,195 @@
+// concat.go
+//
+// Support for the -concat export, which appends every downloaded archive to one long
+// MP3 file and writes a CUE sheet marking where each episode begins. Progress is kept
+// in a small JSON state file next to the export so an interrupted run can resume.
+
+package wmse
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// concatEpisode records one episode that has been appended to the export
+type concatEpisode struct {
+	ArchiveURL   string  `json:"archive_url"`      // URL the episode was downloaded from
+	PlaylistDate string  `json:"playlist_date"`    // Date of the show
+	Start        float64 `json:"start_seconds"`    // Offset in the export where the episode begins
+	Duration     float64 `json:"duration_seconds"` // Playing time of the episode
+}
+
+// concatState is the persisted progress of a -concat export
+type concatState struct {
+	Size     int64           `json:"size"`     // Size of the export after the last complete append
+	Episodes []concatEpisode `json:"episodes"` // Episodes appended so far, in order
+}
+
+// concatExporter appends downloaded archives to a single MP3 file
+type concatExporter struct {
+	path      string
+	cuePath   string
+	statePath string
+	state     concatState
+	appended  map[string]bool
+	blocked   bool
+}
+
+// newConcatExporter prepares an export to path, loading any saved progress
+func newConcatExporter(path string) (*concatExporter, error) {
+	base := strings.TrimSuffix(path, filepath.Ext(path))
+	e := &concatExporter{
+		path:      path,
+		cuePath:   base + ".cue",
+		statePath: path + ".state.json",
+		appended:  make(map[string]bool),
+	}
+
+	data, err := os.ReadFile(e.statePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read concat state: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &e.state); err != nil {
+			return nil, fmt.Errorf("failed to parse concat state %s: %w", e.statePath, err)
+		}
+	}
+
+	for _, ep := range e.state.Episodes {
+		e.appended[ep.ArchiveURL] = true
+	}
+
+	if len(e.state.Episodes) > 0 {
+		slog.Default().Info("Resuming concatenated export",
+			"path", path,
+			"episodes", len(e.state.Episodes))
+	}
+
+	return e, nil
+}
+
+// block stops further appends for the rest of the run so episodes are never written out of order
+func (e *concatExporter) block(archive Archive) {
+	if !e.blocked {
+		slog.Default().Warn("Pausing concatenated export until the missing episode is available",
+			"date", archive.PlaylistDate)
+	}
+	e.blocked = true
+}
+
+// add appends the downloaded archive at srcPath to the export unless it is already there
+func (e *concatExporter) add(archive Archive, srcPath string) error {
+	if e.blocked || e.appended[archive.ArchiveURL] {
+		return nil
+	}
+
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %w", srcPath, err)
+	}
+	defer src.Close()
+
+	duration, err := mp3Duration(src)
+	if err != nil {
+		return fmt.Errorf("could not read MP3 frames from %s: %w", srcPath, err)
+	}
+
+	// Only the first episode's ID3v2 tag belongs at the start of the export; a later one
+	// would sit in the middle of the audio
+	var skip int64
+	if len(e.state.Episodes) > 0 {
+		h := make([]byte, 10)
+		if _, err := src.ReadAt(h, 0); err == nil {
+			skip = int64(id3v2Size(h))
+		}
+	}
+	if _, err := src.Seek(skip, io.SeekStart); err != nil {
+		return fmt.Errorf("could not rewind %s: %w", srcPath, err)
+	}
+
+	out, err := os.OpenFile(e.path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open concat file: %w", err)
+	}
+	defer out.Close()
+
+	// Drop anything left over from an append that was interrupted
+	if err := out.Truncate(e.state.Size); err != nil {
+		return fmt.Errorf("could not truncate concat file: %w", err)
+	}
+	if _, err := out.Seek(e.state.Size, io.SeekStart); err != nil {
+		return fmt.Errorf("could not seek concat file: %w", err)
+	}
+
+	written, err := io.Copy(out, src)
+	if err != nil {
+		return fmt.Errorf("error appending to %s: %w", e.path, err)
+	}
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("failed to sync concat file: %w", err)
+	}
+
+	var start float64
+	if n := len(e.state.Episodes); n > 0 {
+		last := e.state.Episodes[n-1]
+		start = last.Start + last.Duration
+	}
+
+	e.state.Size += written
+	e.state.Episodes = append(e.state.Episodes, concatEpisode{
+		ArchiveURL:   archive.ArchiveURL,
+		PlaylistDate: archive.PlaylistDate,
+		Start:        start,
+		Duration:     duration.Seconds(),
+	})
+	e.appended[archive.ArchiveURL] = true
+
+	if err := e.save(); err != nil {
+		return err
+	}
+
+	slog.Default().Info("Appended to concatenated export",
+		"date", archive.PlaylistDate,
+		"episodes", len(e.state.Episodes))
+
+	return nil
+}
+
+// save writes the state file and regenerates the CUE sheet
+func (e *concatExporter) save() error {
+	data, err := json.MarshalIndent(e.state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode concat state: %w", err)
+	}
+	if err := writeFileAtomic(e.statePath, data, 0644); err != nil {
+		return fmt.Errorf("failed to save concat state: %w", err)
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "FILE \"%s\" MP3\n", filepath.Base(e.path))
+	for i, ep := range e.state.Episodes {
+		fmt.Fprintf(&sb, "  TRACK %02d AUDIO\n", i+1)
+		fmt.Fprintf(&sb, "    TITLE \"%s\"\n", ep.PlaylistDate)
+		fmt.Fprintf(&sb, "    INDEX 01 %s\n", cueTimestamp(ep.Start))
+	}
+	if err := writeFileAtomic(e.cuePath, []byte(sb.String()), 0644); err != nil {
+		return fmt.Errorf("failed to save cue sheet: %w", err)
+	}
+
+	return nil
+}
+
+// cueTimestamp formats an offset in seconds as a CUE mm:ss:ff index (75 frames per second)
+func cueTimestamp(seconds float64) string {
+	d := time.Duration(seconds * float64(time.Second))
+	frames := int64(d%time.Second) * 75 / int64(time.Second)
+	total := int64(d / time.Second)
+	return fmt.Sprintf("%02d:%02d:%02d", total/60, total%60, frames)
+}
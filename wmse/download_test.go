@@ -0,0 +1,329 @@
+package wmse
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testAudio returns size bytes that pass the MP3 check: an empty ID3 tag followed by a
+// pattern made from seed, so different seeds give different files
+func testAudio(size int, seed byte) []byte {
+	data := encodeID3Tag(nil)
+	for len(data) < size {
+		data = append(data, seed+byte(len(data)%251))
+	}
+	return data[:size]
+}
+
+// serveAudio starts a server that serves *content at /a.mp3, with range support, and
+// counts the GET requests it answers
+func serveAudio(t *testing.T, content *[]byte) (*httptest.Server, *int) {
+	t.Helper()
+	gets := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			gets++
+		}
+		http.ServeContent(w, r, "a.mp3", time.Time{}, bytes.NewReader(*content))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &gets
+}
+
+// testOptions returns options for downloading into dir through client without delays
+func testOptions(dir string, client HTTPClient) downloadOptions {
+	return downloadOptions{
+		OutputDir:    dir,
+		Client:       client,
+		APIClient:    client,
+		Location:     time.UTC,
+		Retries:      UniformRetryPolicy(1),
+		Backoff:      constantBackoff{base: time.Millisecond},
+		ProgressMode: progressNone,
+	}
+}
+
+// testArchive returns an archive of srv's file
+func testArchive(srv *httptest.Server) Archive {
+	return Archive{ShowID: "ded", PlaylistDate: "2024-01-01", ArchiveURL: srv.URL + "/a.mp3"}
+}
+
+func TestDownloadShowRestartsWhenArchiveChangedSincePartial(t *testing.T) {
+	old := testAudio(1000, 1)
+	current := testAudio(1500, 7)
+	srv, _ := serveAudio(t, &current)
+	dir := t.TempDir()
+	archive := testArchive(srv)
+	outputPath := filepath.Join(dir, "2024-01-01_ded.mp3")
+
+	// A partial of the old version, whose recorded size no longer matches the server's
+	tempFile := outputPath + tempSuffix
+	if err := os.WriteFile(tempFile, old[:400], 0644); err != nil {
+		t.Fatal(err)
+	}
+	writePartialSize(tempFile+partialSizeSuffix, int64(len(old)))
+
+	if _, err := downloadShow(context.Background(), archive, testOptions(dir, srv.Client())); err != nil {
+		t.Fatalf("downloadShow: %v", err)
+	}
+	got, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, current) {
+		t.Errorf("file does not match the current archive; the old partial was kept")
+	}
+	if _, err := os.Stat(tempFile + partialSizeSuffix); !os.IsNotExist(err) {
+		t.Errorf("size record left behind: %v", err)
+	}
+}
+
+func TestDownloadShowResumesMatchingPartial(t *testing.T) {
+	content := testAudio(1500, 3)
+	var served int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &countingWriter{ResponseWriter: w}
+		http.ServeContent(rec, r, "a.mp3", time.Time{}, bytes.NewReader(content))
+		served += rec.n
+	}))
+	t.Cleanup(srv.Close)
+	dir := t.TempDir()
+	outputPath := filepath.Join(dir, "2024-01-01_ded.mp3")
+
+	tempFile := outputPath + tempSuffix
+	if err := os.WriteFile(tempFile, content[:600], 0644); err != nil {
+		t.Fatal(err)
+	}
+	writePartialSize(tempFile+partialSizeSuffix, int64(len(content)))
+
+	if _, err := downloadShow(context.Background(), testArchive(srv), testOptions(dir, srv.Client())); err != nil {
+		t.Fatalf("downloadShow: %v", err)
+	}
+	got, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("resumed file differs from the archive")
+	}
+	if want := int64(len(content) - 600); served != want {
+		t.Errorf("server sent %d bytes, want only the missing %d", served, want)
+	}
+}
+
+// countingWriter counts the body bytes written through it
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func TestDownloadShowRecoversStaleTempAndLock(t *testing.T) {
+	content := testAudio(1200, 5)
+	srv, _ := serveAudio(t, &content)
+	dir := t.TempDir()
+	outputPath := filepath.Join(dir, "2024-01-01_ded.mp3")
+
+	// An interrupted run left part of the file and the lock of a process that is gone
+	tempFile := outputPath + tempSuffix
+	if err := os.WriteFile(tempFile, content[:500], 0644); err != nil {
+		t.Fatal(err)
+	}
+	lock, err := json.Marshal(tempLock{PID: 1 << 30, Started: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tempFile+tempLockSuffix, lock, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := downloadShow(context.Background(), testArchive(srv), testOptions(dir, srv.Client())); err != nil {
+		t.Fatalf("downloadShow: %v", err)
+	}
+	got, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("file is %d bytes and differs from the %d byte archive", len(got), len(content))
+	}
+	for _, leftover := range []string{tempFile, tempFile + tempLockSuffix, tempFile + partialSizeSuffix} {
+		if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+			t.Errorf("%s left behind: %v", filepath.Base(leftover), err)
+		}
+	}
+}
+
+func TestSkippedArchivesDoNotWait(t *testing.T) {
+	// Nothing is served: every archive is already on disk, one by the state file
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request for %s", r.URL)
+	}))
+	t.Cleanup(srv.Close)
+	dir := t.TempDir()
+	state, err := loadDownloadState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var archives []Archive
+	for i, date := range []string{"2024-01-01", "2024-01-08", "2024-01-15"} {
+		archive := Archive{ShowID: "ded", PlaylistDate: date, ArchiveURL: srv.URL + "/" + date + ".mp3"}
+		path := filepath.Join(dir, date+"_ded.mp3")
+		if err := os.WriteFile(path, testAudio(200, byte(i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			if err := state.record(archive, filepath.Base(path), 200, "", 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		archives = append(archives, archive)
+	}
+
+	// An hour between downloads, so a skip that waits runs into the deadline below
+	newOptions := func(delayOnSkip, paced bool) downloadOptions {
+		opts := testOptions(dir, srv.Client())
+		opts.State = state
+		opts.Delay = time.Hour
+		opts.DelayOnSkip = delayOnSkip
+		if paced {
+			opts.Pacer = newPacer(opts.delay)
+		}
+		return opts
+	}
+
+	for _, paced := range []bool{false, true} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		start := time.Now()
+		outcomes := downloadArchives(ctx, archives, newOptions(false, paced), concurrencyOptions{Workers: 1})
+		cancel()
+		if elapsed := time.Since(start); elapsed >= 5*time.Second {
+			t.Errorf("paced=%v: skipping %d archives took %v", paced, len(archives), elapsed)
+		}
+		for i, outcome := range outcomes {
+			if outcome.Err != nil || !outcome.Skipped {
+				t.Errorf("paced=%v: archive %d: skipped=%v, err=%v; want skipped", paced, i, outcome.Skipped, outcome.Err)
+			}
+		}
+	}
+
+	// With -delay-on-skip the same skips do wait, until the context ends
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	downloadArchives(ctx, archives[:1], newOptions(true, false), concurrencyOptions{Workers: 1})
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("skip with DelayOnSkip returned after %v without waiting", elapsed)
+	}
+}
+
+// stubClient answers every request with a copy of content and, like many test doubles,
+// leaves the response's Request unset
+type stubClient struct {
+	content []byte
+}
+
+func (c stubClient) Do(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": {"audio/mpeg"}},
+		ContentLength: int64(len(c.content)),
+		Body:          io.NopCloser(bytes.NewReader(c.content)),
+	}, nil
+}
+
+func TestDownloadShowWithResponseWithoutRequest(t *testing.T) {
+	content := testAudio(800, 9)
+	dir := t.TempDir()
+	archive := Archive{ShowID: "ded", PlaylistDate: "2024-01-01", ArchiveURL: "https://example.com/a.mp3"}
+	for _, sidecar := range []bool{false, true} {
+		opts := testOptions(dir, stubClient{content: content})
+		opts.MetaSidecar = sidecar
+		opts.Force = true
+		if _, err := downloadShow(context.Background(), archive, opts); err != nil {
+			t.Fatalf("sidecar=%v: downloadShow: %v", sidecar, err)
+		}
+	}
+	data, err := os.ReadFile(metaSidecarPath(filepath.Join(dir, "2024-01-01_ded.mp3")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var meta downloadMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.FinalURL != archive.ArchiveURL {
+		t.Errorf("sidecar final URL = %q, want the request's %q", meta.FinalURL, archive.ArchiveURL)
+	}
+}
+
+func TestDownloadShowRemovesTempAfterPermanentFailure(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(srv.Close)
+	dir := t.TempDir()
+	tempFile := filepath.Join(dir, "2024-01-01_ded.mp3") + tempSuffix
+
+	if _, err := downloadShow(context.Background(), testArchive(srv), testOptions(dir, srv.Client())); err == nil {
+		t.Fatal("downloadShow succeeded against a 404")
+	}
+	for _, leftover := range []string{tempFile, tempFile + tempLockSuffix, tempFile + partialSizeSuffix} {
+		if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+			t.Errorf("%s left behind: %v", filepath.Base(leftover), err)
+		}
+	}
+	if partials, err := FindPartials(dir); err != nil || len(partials) != 0 {
+		t.Errorf("FindPartials = %v, %v; want none", partials, err)
+	}
+}
+
+func TestArchiveChanges(t *testing.T) {
+	content := testAudio(1000, 1)
+	srv, _ := serveAudio(t, &content)
+	dir := t.TempDir()
+	opts := testOptions(dir, srv.Client())
+	state, err := loadDownloadState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.State = state
+
+	archive := testArchive(srv)
+	if _, err := downloadShow(context.Background(), archive, opts); err != nil {
+		t.Fatal(err)
+	}
+	if changes := archiveChanges(context.Background(), []Archive{archive}, opts); len(changes) != 0 {
+		t.Errorf("unchanged archive reported as %+v", changes)
+	}
+
+	moved := archive
+	moved.ArchiveURL += "?v=2"
+	added := Archive{ShowID: "ded", PlaylistDate: "2024-01-08", ArchiveURL: srv.URL + "/b.mp3"}
+	for _, tt := range []struct {
+		archive Archive
+		content []byte
+		want    string
+	}{
+		{added, content, ChangeNew},
+		{moved, content, ChangeURL},
+		{archive, testAudio(1200, 1), ChangeSize},
+	} {
+		content = tt.content
+		changes := archiveChanges(context.Background(), []Archive{tt.archive}, opts)
+		if len(changes) != 1 || changes[0].Change != tt.want {
+			t.Errorf("changes of %s = %+v, want one %q", tt.archive.ArchiveURL, changes, tt.want)
+		}
+	}
+}
@@ -0,0 +1,600 @@
+// downloader.go
+//
+// The package's public entry point. A Downloader is configured once from Options and then
+// looks shows up, fetches their archive lists and downloads episodes; the command line
+// tool is a thin wrapper that fills in Options from flags and calls these methods.
+
+package wmse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options configures a Downloader. Start from DefaultOptions and change what you need.
+type Options struct {
+	OutputDir         string            // Directory to save MP3 files
+	Delay             time.Duration     // Pause between downloads to avoid hammering the server
+	Debug             bool              // Log detailed download progress
+	MaxFilenameLength int               // Maximum length of generated file names in bytes
+	FilenameTemplate  string            // text/template for each file's path under OutputDir; empty for <date>_<show>.mp3
+	Timezone          string            // Time zone playlist dates are read in
+	LogSkips          bool              // Log each file skipped because it already exists
+	DelayOnSkip       bool              // Also pause after archives skipped because they are already present
+	ProgressMode      string            // How progress is reported: one of ProgressModes
+	ProgressInterval  time.Duration     // How often the log and line progress modes report
+	Client            HTTPClient        // Sends MP3 downloads; a client with DownloadTimeout if nil
+	APIClient         HTTPClient        // Sends page, API and playlist requests; a client with APITimeout if nil
+	DownloadTimeout   time.Duration     // Time limit for each MP3 download by the default client
+	APITimeout        time.Duration     // Time limit for each page, API and playlist request by the default client
+	Transport         http.RoundTripper // Transport for the default clients; built from Proxy if nil
+	Proxy             string            // Proxy URL for the default transport; the environment's proxy if empty
+	BaseURL           string            // WMSE website that program pages are read from
+	APIURL            string            // WMSE API that archive lists and playlists are read from
+
+	Retries              RetryPolicy   // How many times to retry each kind of failure
+	Backoff              string        // Retry delay strategy: one of BackoffNames
+	BackoffBase          time.Duration // Delay before the first retry
+	BackoffCap           time.Duration // Longest delay between retries (0 for no limit)
+	BackoffJitter        bool          // Wait a random time up to the backoff delay instead of the full delay
+	DeferRetries         bool          // Try each download once, then retry the failures in a second pass
+	DeferRetriesCooldown time.Duration // Pause before the DeferRetries second pass
+	BreakerFailures      int           // Consecutive server or network failures that pause all downloads (0 to never pause)
+	BreakerCooldown      time.Duration // Length of the first pause; each further pause is twice as long
+	BreakerMaxCooldowns  int           // Pauses allowed before the rest of the run is abandoned
+
+	Concurrency          int           // Number of archives downloaded in parallel
+	ConcurrencyAuto      bool          // Adapt the number of parallel downloads to measured throughput
+	MaxWorkers           int           // Upper limit for ConcurrencyAuto
+	ConcurrencySafeDelay bool          // Space download starts Delay apart across all workers
+	MaxConcurrentHosts   int           // Limit on distinct hosts downloaded from at once (0 for no limit)
+	MaxBandwidth         int64         // Cap on total download speed in bytes per second (0 for no limit)
+	AdaptiveDelay        bool          // Increase Delay while the server is responding slowly
+	LatencyHigh          time.Duration // Response time above which AdaptiveDelay doubles the delay
+	LatencyLow           time.Duration // Response time below which AdaptiveDelay eases the delay back
+	MaxAdaptiveDelay     time.Duration // Longest delay AdaptiveDelay will use
+
+	PlaylistTemplate  string // text/template for each playlist line
+	PlaylistFormat    string // Format of saved playlist files: one of PlaylistFormats
+	Tags              bool   // Write show details and the playlist into the MP3 as ID3 tags instead of a .txt
+	Chapters          bool   // Also mark each track as an ID3 chapter, when the playlist has track times
+	SetMtime          bool   // Set each MP3's modification time to its air date, or the server's Last-Modified
+	FetchLinks        bool   // Download resources linked from the playlist
+	MetaSidecar       bool   // Write a .meta.json provenance record next to each file
+	Strict            bool   // Fail downloads whose playlist or extras could not be saved
+	SkipMissingURL    bool   // Treat archives without an MP3 URL as pending rather than failed
+	NoAtomic          bool   // Write straight to the final path instead of a temp file and rename
+	KeepFailed        bool   // Keep downloads rejected for their content type or size as <name>.failed
+	GlobalStore       string // Content-addressed store that downloads are linked into, if set
+	Timings           bool   // Log DNS, connect, TLS, first-byte and transfer times for each download
+	FinalVerify       bool   // Re-hash every downloaded file after the run
+	VerifyConcurrency int    // Number of files hashed in parallel when verifying
+	MatchByHash       bool   // Skip archives whose content hash matches a file already in OutputDir
+	Force             bool   // Download every archive again, ignoring the state file and files already present
+	Overwrite         string // What to do with archives already downloaded: one of OverwriteModes; "always" is the same as Force
+	MaxFileSize       int64  // Largest archive accepted, in bytes; larger ones fail without being downloaded
+
+	ArchiveCacheTTL time.Duration // Reuse an archive list fetched less than this long ago (0 to always fetch)
+	RefreshArchives bool          // Ignore the cached archive list but still save the new one
+	SavePage        bool          // Save the show's program page HTML in OutputDir
+	SavePageText    bool          // Also save a plain-text version of the program page
+}
+
+// DefaultOptions returns the settings the command line tool starts from
+func DefaultOptions() Options {
+	return Options{
+		OutputDir:            "./archives",
+		Delay:                5 * time.Second,
+		MaxFilenameLength:    255,
+		FilenameTemplate:     defaultFilenameTemplate,
+		Timezone:             defaultTimezone,
+		ProgressMode:         progressBar,
+		ProgressInterval:     defaultProgressInterval,
+		DownloadTimeout:      defaultDownloadTimeout,
+		APITimeout:           defaultAPITimeout,
+		BaseURL:              defaultBaseURL,
+		APIURL:               defaultAPIURL,
+		SetMtime:             true,
+		Retries:              defaultRetryPolicy(),
+		Backoff:              "exponential",
+		BackoffBase:          defaultBackoffBase,
+		BackoffCap:           defaultBackoffCap,
+		BackoffJitter:        true,
+		DeferRetriesCooldown: time.Minute,
+		BreakerFailures:      defaultBreakerFailures,
+		BreakerCooldown:      defaultBreakerCooldown,
+		BreakerMaxCooldowns:  defaultBreakerMaxCooldowns,
+		Concurrency:          1,
+		MaxWorkers:           8,
+		LatencyHigh:          defaultLatencyHigh,
+		LatencyLow:           defaultLatencyLow,
+		MaxAdaptiveDelay:     defaultMaxAdaptiveDelay,
+		PlaylistTemplate:     defaultPlaylistTemplate,
+		PlaylistFormat:       "txt",
+		Overwrite:            "never",
+		MaxFileSize:          maxFileSize,
+		VerifyConcurrency:    defaultVerifyConcurrency(),
+		ArchiveCacheTTL:      defaultArchiveCacheTTL,
+	}
+}
+
+// Downloader looks up WMSE shows and downloads their archives
+type Downloader struct {
+	opts         downloadOptions
+	conc         concurrencyOptions
+	deferRetries bool
+	cooldown     time.Duration
+	verifyConc   int
+	matchByHash  bool
+	cacheTTL     time.Duration
+	refresh      bool
+	savePage     bool
+	savePageText bool
+	dirs         *outputDirs // Records of each output directory, shared with WithOptions
+}
+
+// outputDirs is the state file and checksum manifest of each output directory in a run, so
+// Downloaders writing to the same directory keep one record between them
+type outputDirs struct {
+	mu        sync.Mutex
+	states    map[string]*downloadState
+	checksums map[string]*checksumLog
+}
+
+// share returns the records already kept for dir, or registers state and checksums as them
+func (r *outputDirs) share(dir string, state *downloadState, checksums *checksumLog) (*downloadState, *checksumLog) {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.states[dir]; !ok {
+		r.states[dir] = state
+		r.checksums[dir] = checksums
+	}
+	return r.states[dir], r.checksums[dir]
+}
+
+// New checks o and returns a Downloader configured by it
+func New(o Options) (*Downloader, error) {
+	if o.MaxFilenameLength < MinFilenameLength {
+		return nil, fmt.Errorf("maximum filename length must be at least %d, got %d", MinFilenameLength, o.MaxFilenameLength)
+	}
+	if err := validateOutputDir(o.OutputDir); err != nil {
+		return nil, err
+	}
+	if !slices.Contains(ProgressModes, o.ProgressMode) {
+		return nil, fmt.Errorf("unknown progress mode %q (want one of %s)", o.ProgressMode, strings.Join(ProgressModes, ", "))
+	}
+	if o.ProgressInterval <= 0 {
+		return nil, errors.New("progress interval must be positive")
+	}
+	if o.DownloadTimeout <= 0 || o.APITimeout <= 0 {
+		return nil, errors.New("timeouts must be positive")
+	}
+	if o.MaxConcurrentHosts < 0 {
+		return nil, errors.New("maximum concurrent hosts must not be negative")
+	}
+	if o.MaxFileSize <= 0 {
+		return nil, errors.New("maximum file size must be positive")
+	}
+	if o.MaxBandwidth < 0 {
+		return nil, errors.New("maximum bandwidth must not be negative")
+	}
+	if o.VerifyConcurrency < 1 {
+		return nil, errors.New("verify concurrency must be at least 1")
+	}
+	if o.Concurrency < 1 {
+		return nil, errors.New("concurrency must be at least 1")
+	}
+	if o.ConcurrencyAuto && o.MaxWorkers < 1 {
+		return nil, errors.New("maximum workers must be at least 1")
+	}
+	if o.Overwrite != "" && !slices.Contains(OverwriteModes, o.Overwrite) {
+		return nil, fmt.Errorf("unknown overwrite mode %q (want one of %s)", o.Overwrite, strings.Join(OverwriteModes, ", "))
+	}
+	if o.PlaylistFormat != "" && !slices.Contains(PlaylistFormats, o.PlaylistFormat) {
+		return nil, fmt.Errorf("unknown playlist format %q (want one of %s)", o.PlaylistFormat, strings.Join(PlaylistFormats, ", "))
+	}
+	if o.BreakerFailures < 0 || o.BreakerMaxCooldowns < 0 || o.BreakerCooldown < 0 {
+		return nil, errors.New("circuit breaker settings must not be negative")
+	}
+	if o.Retries.ServerError < 0 || o.Retries.Network < 0 || o.Retries.Timeout < 0 || o.Retries.Other < 0 {
+		return nil, errors.New("retry counts must not be negative")
+	}
+
+	loc, err := time.LoadLocation(o.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %q: %w", o.Timezone, err)
+	}
+	baseURL, err := validateServiceURL("base", o.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	apiURL, err := validateServiceURL("API", o.APIURL)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := downloadOptions{
+		OutputDir:         o.OutputDir,
+		Delay:             o.Delay,
+		Debug:             o.Debug,
+		MaxFilenameLength: o.MaxFilenameLength,
+		LogSkips:          o.LogSkips,
+		FetchLinks:        o.FetchLinks,
+		Strict:            o.Strict,
+		MetaSidecar:       o.MetaSidecar,
+		DelayOnSkip:       o.DelayOnSkip,
+		Tags:              o.Tags,
+		Chapters:          o.Chapters,
+		SetMtime:          o.SetMtime,
+		ProgressMode:      o.ProgressMode,
+		ProgressInterval:  o.ProgressInterval,
+		NoAtomic:          o.NoAtomic,
+		KeepFailed:        o.KeepFailed,
+		GlobalStore:       o.GlobalStore,
+		SkipMissingURL:    o.SkipMissingURL,
+		Retries:           o.Retries,
+		PlaylistFormat:    o.PlaylistFormat,
+		Client:            o.Client,
+		APIClient:         o.APIClient,
+		Seen:              &runURLs{},
+		Checksums:         newChecksumLog(o.OutputDir),
+		Force:             o.Force || o.Overwrite == "always",
+		Overwrite:         o.Overwrite,
+		MaxFileSize:       o.MaxFileSize,
+		Location:          loc,
+		BaseURL:           baseURL,
+		APIURL:            apiURL,
+	}
+	// The default clients share one transport, and so one connection pool
+	transport := o.Transport
+	if transport == nil && (opts.Client == nil || opts.APIClient == nil) {
+		shared, err := NewTransport(o.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport = shared
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: o.DownloadTimeout, Transport: transport}
+	}
+	if opts.APIClient == nil {
+		opts.APIClient = &http.Client{Timeout: o.APITimeout, Transport: transport}
+	}
+
+	// The default is applied without a template so names stay exactly as they always were
+	if o.FilenameTemplate != "" && o.FilenameTemplate != defaultFilenameTemplate {
+		if opts.FilenameTemplate, err = parseFilenameTemplate(o.FilenameTemplate); err != nil {
+			return nil, err
+		}
+	}
+	if opts.PlaylistTemplate, err = parsePlaylistTemplate(o.PlaylistTemplate); err != nil {
+		return nil, err
+	}
+	if opts.Backoff, err = newBackoff(o.Backoff, o.BackoffBase, o.BackoffCap); err != nil {
+		return nil, err
+	}
+	if o.BackoffJitter {
+		opts.Backoff = fullJitter{opts.Backoff}
+	}
+
+	if opts.State, err = loadDownloadState(o.OutputDir); err != nil {
+		return nil, err
+	}
+	if o.FinalVerify {
+		opts.Hashes = &hashRecorder{}
+	}
+	if o.Timings {
+		opts.Timings = &timingCollector{}
+	}
+	if o.AdaptiveDelay {
+		opts.Throttle = newLatencyThrottle(o.Delay, o.LatencyHigh, o.LatencyLow, o.MaxAdaptiveDelay)
+		// Both clients feed the throttle so it sees every request
+		opts.Client = &latencyClient{throttle: opts.Throttle, base: opts.Client}
+		opts.APIClient = &latencyClient{throttle: opts.Throttle, base: opts.APIClient}
+	}
+	if o.BreakerFailures > 0 {
+		opts.Breaker = newCircuitBreaker(o.BreakerFailures, o.BreakerCooldown, o.BreakerMaxCooldowns)
+	}
+	if o.MaxConcurrentHosts > 0 {
+		opts.Hosts = newHostLimiter(o.MaxConcurrentHosts)
+	}
+	if o.MaxBandwidth > 0 {
+		opts.Bandwidth = newBandwidthLimiter(o.MaxBandwidth)
+	}
+	if o.ConcurrencySafeDelay {
+		opts.Pacer = newPacer(opts.delay)
+	}
+
+	dirs := &outputDirs{
+		states:    make(map[string]*downloadState),
+		checksums: make(map[string]*checksumLog),
+	}
+	dirs.share(opts.OutputDir, opts.State, opts.Checksums)
+
+	return &Downloader{
+		opts:         opts,
+		conc:         concurrencyOptions{Workers: o.Concurrency, Auto: o.ConcurrencyAuto, MaxWorkers: o.MaxWorkers},
+		deferRetries: o.DeferRetries,
+		cooldown:     o.DeferRetriesCooldown,
+		verifyConc:   o.VerifyConcurrency,
+		matchByHash:  o.MatchByHash,
+		cacheTTL:     o.ArchiveCacheTTL,
+		refresh:      o.RefreshArchives,
+		savePage:     o.SavePage || o.SavePageText,
+		savePageText: o.SavePageText,
+		dirs:         dirs,
+	}, nil
+}
+
+// WithOptions returns a Downloader configured by o that shares the run-wide parts of d: its
+// bandwidth, host and circuit breaker limits, its metrics, its final verification list, the
+// URLs it has saved, and the state file and checksum manifest of each output directory. It is
+// meant for shows whose settings differ from the rest of a run.
+func (d *Downloader) WithOptions(o Options) (*Downloader, error) {
+	nd, err := New(o)
+	if err != nil {
+		return nil, err
+	}
+	nd.opts.Bandwidth = d.opts.Bandwidth
+	nd.opts.Hosts = d.opts.Hosts
+	nd.opts.Breaker = d.opts.Breaker
+	nd.opts.Metrics = d.opts.Metrics
+	nd.opts.Hashes = d.opts.Hashes
+	nd.opts.Seen = d.opts.Seen
+	nd.dirs = d.dirs
+	nd.opts.State, nd.opts.Checksums = d.dirs.share(nd.opts.OutputDir, nd.opts.State, nd.opts.Checksums)
+	return nd, nil
+}
+
+// ArchiveID looks up the archive ID on a show's program page, saving the page if
+// Options.SavePage is set
+func (d *Downloader) ArchiveID(ctx context.Context, showID string) (string, error) {
+	id, page, err := getShowArchiveID(ctx, d.opts.apiClient(), d.opts.baseURL(), showID)
+	if err != nil {
+		return "", err
+	}
+
+	if d.savePage {
+		if err := savePage(page, showID, d.opts.OutputDir, d.savePageText); err != nil {
+			if err := reportProblem(d.opts, "Failed to save program page", err); err != nil {
+				return "", err
+			}
+		}
+	}
+	return id, nil
+}
+
+// Archives fetches the archive list for archiveID, reusing a recently cached copy
+// within Options.ArchiveCacheTTL
+func (d *Downloader) Archives(ctx context.Context, archiveID string) ([]Archive, error) {
+	if err := ValidateArchiveID(archiveID); err != nil {
+		return nil, err
+	}
+	archives, err := fetchArchivesCached(ctx, d.opts.apiClient(), d.opts.apiURL(), archiveID, d.cacheTTL, d.refresh)
+	if err != nil {
+		return nil, err
+	}
+	return archives, d.checkArchives(archives)
+}
+
+// LoadArchives reads an archive list previously saved in the API's JSON format
+func (d *Downloader) LoadArchives(path string) ([]Archive, error) {
+	archives, err := loadArchivesFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return archives, d.checkArchives(archives)
+}
+
+// checkArchives parses the archives' dates, warns about unlikely ones and, with Options.MatchByHash, hashes the files
+// already in the output directory so archives can be matched to them by content
+func (d *Downloader) checkArchives(archives []Archive) error {
+	if len(archives) == 0 {
+		return nil
+	}
+	setArchiveDates(archives, d.opts.Location)
+	warnFutureDates(archives, time.Now(), d.opts.Location)
+
+	if !d.matchByHash {
+		return nil
+	}
+	if !slices.ContainsFunc(archives, func(a Archive) bool { return a.SHA256 != "" }) {
+		slog.Default().Warn("Archive list has no content hashes, so matching by hash cannot match anything")
+		return nil
+	}
+	hashes, err := hashDirectory(d.opts.OutputDir, d.verifyConc)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to hash existing files: %w", err)
+	}
+	d.opts.ExistingHashes = hashes
+	slog.Default().Info("Hashed existing files", "count", len(hashes))
+	return nil
+}
+
+// LastDownloaded returns the date of the newest of archives already in the output
+// directory, and false if none of them are
+func (d *Downloader) LastDownloaded(archives []Archive) (time.Time, bool) {
+	opts := d.opts
+	opts.Force = false // Only what is on disk matters, not whether it will be fetched again
+	var newest time.Time
+	found := false
+	for _, archive := range archives {
+		date, ok := archiveDate(archive)
+		if !ok || !opts.present(archive) {
+			continue
+		}
+		if !found || date.After(newest) {
+			newest, found = date, true
+		}
+	}
+	return newest.In(d.opts.Location), found
+}
+
+// Download fetches one archive into the output directory
+func (d *Downloader) Download(ctx context.Context, archive Archive) (Result, error) {
+	return downloadShow(ctx, archive, d.opts)
+}
+
+// DownloadURL pushes a single URL through the normal download pipeline under a fresh
+// timestamped name, for diagnosing one link
+func (d *Downloader) DownloadURL(ctx context.Context, rawURL string) error {
+	return runTestURL(ctx, rawURL, d.opts)
+}
+
+// DownloadAll downloads every archive, in parallel if configured, and returns the outcomes
+// in archive order. A failed download does not stop the others; cancelling ctx stops the
+// downloads in progress and leaves the rest undone.
+func (d *Downloader) DownloadAll(ctx context.Context, archives []Archive) []Outcome {
+	var outcomes []Outcome
+	if d.deferRetries {
+		// One attempt each first, then a second pass with the full retry policy
+		firstPass := d.opts
+		firstPass.Retries = RetryPolicy{}
+		outcomes = downloadArchives(ctx, archives, firstPass, d.conc)
+		retryDeferred(ctx, archives, outcomes, d.opts, d.conc, d.cooldown)
+	} else {
+		outcomes = downloadArchives(ctx, archives, d.opts, d.conc)
+	}
+
+	if d.opts.Timings != nil {
+		d.opts.Timings.report()
+	}
+	return outcomes
+}
+
+// Changes returns the archives that are new or have changed upstream since they were
+// downloaded, by the state file
+func (d *Downloader) Changes(ctx context.Context, archives []Archive) []ArchiveChange {
+	return archiveChanges(ctx, archives, d.opts)
+}
+
+// Replace has later downloads fetch archives again even though they are already downloaded
+func (d *Downloader) Replace(archives []Archive) {
+	if d.opts.Replace == nil {
+		d.opts.Replace = make(map[string]bool)
+	}
+	for _, archive := range archives {
+		d.opts.Replace[stateKey(archive)] = true
+	}
+}
+
+// Concat appends each successfully downloaded archive, oldest first, to the single MP3 file at
+// path and keeps a CUE sheet beside it. Appending stops at the first archive that is
+// missing, so episodes are never out of order; a later run picks up where it left off.
+func (d *Downloader) Concat(path string, archives []Archive, outcomes []Outcome) error {
+	exporter, err := newConcatExporter(path)
+	if err != nil {
+		return err
+	}
+
+	// The export runs oldest to newest whatever order the archives were downloaded in
+	for _, i := range dateOrder(archives, false) {
+		archive := archives[i]
+		if outcomes[i].Err != nil {
+			exporter.block(archive)
+			continue
+		}
+		if err := exporter.add(archive, outcomes[i].Path); err != nil {
+			slog.Default().Error("Failed to append to concatenated export",
+				"archive", archive.ShowID,
+				"error", err)
+			exporter.block(archive)
+		}
+	}
+	return nil
+}
+
+// Prune keeps the newest keep episodes of each show in the output directory. Files in
+// protected are never removed, and nothing is deleted unless apply is set.
+func (d *Downloader) Prune(archives []Archive, keep int, protected map[string]bool, apply bool) error {
+	return pruneArchives(archives, d.opts, keep, protected, apply)
+}
+
+// UpdateM3U adds the episodes downloaded in this run to the M3U playlist named name in the
+// output directory
+func (d *Downloader) UpdateM3U(name string, archives []Archive, outcomes []Outcome) error {
+	var entries []m3uEntry
+	for i, archive := range archives {
+		if outcomes[i].Err != nil || outcomes[i].Skipped {
+			continue
+		}
+		file := filepath.ToSlash(d.opts.archiveFilename(archive))
+		entries = append(entries, newM3UEntry(archive, file, d.opts.Location))
+	}
+	return updateM3U(filepath.Join(d.opts.OutputDir, name), entries, d.opts.Location)
+}
+
+// PartialArchives returns the archives whose unfinished download is one of the temp files
+// in partials, as found by FindPartials, and removes those temp files from partials
+func (d *Downloader) PartialArchives(archives []Archive, partials map[string]bool) []Archive {
+	return partialArchives(archives, d.opts, partials)
+}
+
+// FinalVerify re-hashes every file downloaded so far and returns the number that no longer
+// match. It does nothing unless Options.FinalVerify is set.
+func (d *Downloader) FinalVerify() int {
+	if d.opts.Hashes == nil {
+		return 0
+	}
+	return d.opts.Hashes.finalVerify(d.verifyConc)
+}
+
+// VerifyChecksums re-hashes every file listed in the output directory's checksums.txt and
+// returns the number that are missing or corrupted
+func (d *Downloader) VerifyChecksums() (int, error) {
+	return verifyChecksums(d.opts.OutputDir, d.verifyConc)
+}
+
+// DryRun writes a table of the archives, showing which would be downloaded or skipped
+func (d *Downloader) DryRun(ctx context.Context, archives []Archive, w io.Writer) error {
+	return dryRun(ctx, archives, d.opts, w)
+}
+
+// ListPlaylists writes the playlist of every archive to w
+func (d *Downloader) ListPlaylists(ctx context.Context, archives []Archive, w io.Writer) error {
+	return listPlaylists(ctx, archives, d.opts, w)
+}
+
+// BackfillPlaylists saves the missing playlist files of archives already downloaded,
+// without downloading any audio, and returns how many were saved and how many failed
+func (d *Downloader) BackfillPlaylists(ctx context.Context, archives []Archive) (saved, failed int) {
+	return backfillPlaylists(ctx, archives, d.opts)
+}
+
+// EstimateSize writes the total size of the archives still to download to w
+func (d *Downloader) EstimateSize(ctx context.Context, archives []Archive, w io.Writer) {
+	estimateSize(ctx, archives, d.opts).print(w)
+}
+
+// VerifyHTMLStructure checks that a show's program page still has the markup ArchiveID
+// relies on
+func (d *Downloader) VerifyHTMLStructure(ctx context.Context, showID string) error {
+	return verifyHTMLStructure(ctx, d.opts.apiClient(), d.opts.baseURL(), showID)
+}
+
+// ServeMetrics starts counting the run's downloads and serves the counts at /metrics on
+// addr in the background, in the Prometheus text format
+func (d *Downloader) ServeMetrics(addr string) {
+	if d.opts.Metrics == nil {
+		d.opts.Metrics = newRunMetrics()
+	}
+	startMetricsServer(addr, d.opts.Metrics)
+}
+
+// Serve serves the output directory over HTTP on addr in the background
+func (d *Downloader) Serve(addr string) {
+	startArchiveServer(addr, d.opts.OutputDir)
+}
@@ -0,0 +1,62 @@
+// dryrun.go
+//
+// Support for -dry-run, which lists every archive with the file it would be saved as and
+// whether it would be downloaded or skipped, without writing anything to disk.
+
+package wmse
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"text/tabwriter"
+)
+
+// dryRun writes a table of what a real run would do with each archive to w, followed by
+// the totals. Sizes come from HEAD requests for the archives that would be downloaded.
+func dryRun(ctx context.Context, archives []Archive, opts downloadOptions, w io.Writer) error {
+	logger := slog.Default()
+	client := opts.apiClient()
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "DATE\tSHOW\tFILE\tACTION\tSIZE")
+
+	var est sizeEstimate
+	for _, archive := range archives {
+		filename := opts.archiveFilename(archive)
+		action, size := "download", "unknown"
+
+		switch {
+		case opts.present(archive):
+			action, size = "skip (exists)", "-"
+			est.Present++
+		case archive.ArchiveURL == "":
+			action, size = "fail (no URL)", "-"
+			est.Unknown++
+		default:
+			n, err := headContentLength(ctx, client, archive.ArchiveURL)
+			if err != nil {
+				logger.Warn("Could not get archive size",
+					"date", archive.PlaylistDate,
+					"error", err)
+			}
+			if n < 0 {
+				est.Unknown++
+			} else {
+				size = formatBytes(n)
+				est.Known++
+				est.TotalBytes += n
+			}
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", archive.PlaylistDate, archive.ShowID, filename, action, size)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w)
+	est.print(w)
+	return nil
+}
@@ -0,0 +1,56 @@
+// encoding.go
+//
+// Decompressing API responses. Go's transport only undoes gzip it asked for itself, so once
+// a request sets its own Accept-Encoding the body arrives compressed. Archive lists and
+// playlists ask for gzip or deflate explicitly and are unpacked here before decoding.
+
+package wmse
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// acceptEncoding is the Accept-Encoding sent with API requests
+const acceptEncoding = "gzip, deflate"
+
+// decodedBody returns a reader of resp's body with any Content-Encoding removed. Closing it
+// does not close the body.
+func decodedBody(resp *http.Response) (io.ReadCloser, error) {
+	encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+		return io.NopCloser(resp.Body), nil
+	case "gzip", "x-gzip":
+		r, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip response: %w", err)
+		}
+		return r, nil
+	case "deflate":
+		// Deflate should be zlib-wrapped, but some servers send the raw stream
+		br := bufio.NewReader(resp.Body)
+		if header, err := br.Peek(2); err == nil && isZlibHeader(header) {
+			r, err := zlib.NewReader(br)
+			if err != nil {
+				return nil, fmt.Errorf("invalid deflate response: %w", err)
+			}
+			return r, nil
+		}
+		return flate.NewReader(br), nil
+	default:
+		return nil, fmt.Errorf("unsupported response encoding %q", encoding)
+	}
+}
+
+// isZlibHeader reports whether b starts a zlib stream: deflate compression with a valid
+// header checksum
+func isZlibHeader(b []byte) bool {
+	return b[0]&0x0f == 8 && (uint16(b[0])<<8|uint16(b[1]))%31 == 0
+}
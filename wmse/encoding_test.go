@@ -0,0 +1,86 @@
+package wmse
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// compressors encode a response body for each Content-Encoding the API may use
+var compressors = map[string]func(io.Writer) io.WriteCloser{
+	"gzip":        func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+	"deflate":     func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) },
+	"raw deflate": func(w io.Writer) io.WriteCloser { fw, _ := flate.NewWriter(w, flate.DefaultCompression); return fw },
+}
+
+// serveCompressed starts a server answering the archive list and playlist requests with
+// JSON compressed by the named compressor
+func serveCompressed(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	responses := map[string]string{
+		"/api/shows/123":   `[{"show_id": "ded", "archive_url": "https://example.com/a.mp3", "playlist_date": "2024-01-01", "show_name": "Dead Air"}]`,
+		"/api/playlists/7": `{"tracks": [{"artist": "Low", "title": "Words"}]}`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := responses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Accept-Encoding") != acceptEncoding {
+			t.Errorf("request for %s asked for %q, want %q", r.URL.Path, r.Header.Get("Accept-Encoding"), acceptEncoding)
+		}
+		var buf bytes.Buffer
+		cw := compressors[name](&buf)
+		io.WriteString(cw, body)
+		cw.Close()
+		encoding := name
+		if name == "raw deflate" {
+			encoding = "deflate"
+		}
+		w.Header().Set("Content-Encoding", encoding)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(buf.Bytes())
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestCompressedAPIResponses(t *testing.T) {
+	for name := range compressors {
+		t.Run(name, func(t *testing.T) {
+			srv := serveCompressed(t, name)
+			o := DefaultOptions()
+			o.OutputDir = t.TempDir()
+			o.APIURL = srv.URL
+			o.ArchiveCacheTTL = 0
+			o.APIClient = srv.Client()
+			d, err := New(o)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			archives, err := d.Archives(context.Background(), "123")
+			if err != nil {
+				t.Fatalf("Archives: %v", err)
+			}
+			if len(archives) != 1 || archives[0].Name != "Dead Air" {
+				t.Errorf("Archives = %+v, want the one Dead Air archive", archives)
+			}
+
+			tracks, _, err := fetchPlaylist(context.Background(), srv.Client(), srv.URL, "7")
+			if err != nil {
+				t.Fatalf("fetchPlaylist: %v", err)
+			}
+			if len(tracks) != 1 || tracks[0]["artist"] != "Low" || tracks[0]["title"] != "Words" {
+				t.Errorf("fetchPlaylist = %v, want the one track by Low", tracks)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+// estimate.go
+//
+// Support for -estimate-size, which asks the server for the size of every archive with a
+// HEAD request and reports the total before anything is downloaded.
+
+package wmse
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// sizeEstimate is the outcome of -estimate-size
+type sizeEstimate struct {
+	Known      int   // Archives whose size the server reported
+	Unknown    int   // Archives with no usable Content-Length
+	Present    int   // Archives already on disk, which will be skipped
+	TotalBytes int64 // Sum of the known sizes
+}
+
+// headContentLength returns the Content-Length the server reports for url, or -1 if it gives none
+func headContentLength(ctx context.Context, client HTTPClient, url string) (int64, error) {
+	size, _, err := headArchive(ctx, client, url)
+	return size, err
+}
+
+// headArchive returns the Content-Length and Last-Modified time the server reports for url,
+// with -1 for a missing length and the zero time for a missing or unreadable date
+func headArchive(ctx context.Context, client HTTPClient, url string) (int64, time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return -1, time.Time{}, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.4 Safari/605.1.15")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return -1, time.Time{}, fmt.Errorf("failed to HEAD %s: %w", url, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return -1, time.Time{}, fmt.Errorf("bad status for HEAD %s: %s", url, resp.Status)
+	}
+
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return resp.ContentLength, modified, nil
+}
+
+// estimateSize totals the sizes of the archives that still need downloading
+func estimateSize(ctx context.Context, archives []Archive, opts downloadOptions) sizeEstimate {
+	logger := slog.Default()
+	client := opts.apiClient()
+
+	var est sizeEstimate
+	for _, archive := range archives {
+		if opts.present(archive) {
+			est.Present++
+			continue
+		}
+
+		if archive.ArchiveURL == "" {
+			est.Unknown++
+			continue
+		}
+
+		size, err := headContentLength(ctx, client, archive.ArchiveURL)
+		if err != nil {
+			logger.Warn("Could not get archive size",
+				"date", archive.PlaylistDate,
+				"error", err)
+		}
+		if size < 0 {
+			est.Unknown++
+			continue
+		}
+
+		logger.Debug("Archive size",
+			"date", archive.PlaylistDate,
+			"bytes", size)
+		est.Known++
+		est.TotalBytes += size
+	}
+
+	return est
+}
+
+// print writes a human-readable report of the estimate to w
+func (est sizeEstimate) print(w io.Writer) {
+	fmt.Fprintf(w, "Archives to download: %d\n", est.Known+est.Unknown)
+	fmt.Fprintf(w, "  with known size:    %d (%s)\n", est.Known, formatBytes(est.TotalBytes))
+	fmt.Fprintf(w, "  with unknown size:  %d\n", est.Unknown)
+	fmt.Fprintf(w, "Already present:      %d\n", est.Present)
+}
+
+// formatBytes renders a byte count using binary units
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,90 @@
+// extract.go
+//
+// Archive ID extraction strategies. The program page is expected to carry a
+// <wmse-archive show-id="..."> element, but if WMSE renames it the ID can often still be
+// found elsewhere on the page. Strategies are tried in order and the first valid ID wins.
+
+package wmse
+
+import (
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// scriptArchiveIDPattern matches a show ID in JSON or JavaScript embedded in a script
+// element, e.g. "showId": "1234" or show_id: 1234
+var scriptArchiveIDPattern = regexp.MustCompile(`["']?show[_-]?[iI][dD]["']?\s*:\s*["']?([a-zA-Z0-9_-]+)`)
+
+// archiveIDStrategy is one way of finding the archive ID on a program page
+type archiveIDStrategy struct {
+	name    string
+	extract func(doc *html.Node) string
+}
+
+// archiveIDStrategies are tried in order; the first is the page's expected markup
+var archiveIDStrategies = []archiveIDStrategy{
+	{name: "wmse-archive element", extract: findArchiveID},
+	{name: "inline script", extract: findScriptArchiveID},
+	{name: "data-show-id attribute", extract: findDataShowID},
+}
+
+// extractArchiveID returns the first valid archive ID found by archiveIDStrategies, with
+// the name of the strategy that found it, or two empty strings if none did
+func extractArchiveID(doc *html.Node) (id, strategy string) {
+	for _, s := range archiveIDStrategies {
+		if id := s.extract(doc); id != "" && ValidateArchiveID(id) == nil {
+			return id, s.name
+		}
+	}
+	return "", ""
+}
+
+// findNode returns the result of match for the first node, in document order, for which
+// it is not empty
+func findNode(n *html.Node, match func(*html.Node) string) string {
+	if v := match(n); v != "" {
+		return v
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if v := findNode(c, match); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// findScriptArchiveID looks for a show ID in the text of inline script elements
+func findScriptArchiveID(doc *html.Node) string {
+	return findNode(doc, func(n *html.Node) string {
+		if n.Type != html.ElementNode || n.Data != "script" {
+			return ""
+		}
+		var sb strings.Builder
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.TextNode {
+				sb.WriteString(c.Data)
+			}
+		}
+		if m := scriptArchiveIDPattern.FindStringSubmatch(sb.String()); m != nil {
+			return m[1]
+		}
+		return ""
+	})
+}
+
+// findDataShowID returns the data-show-id attribute of the first element that has one
+func findDataShowID(doc *html.Node) string {
+	return findNode(doc, func(n *html.Node) string {
+		if n.Type != html.ElementNode {
+			return ""
+		}
+		for _, attr := range n.Attr {
+			if attr.Key == "data-show-id" {
+				return strings.TrimSpace(attr.Val)
+			}
+		}
+		return ""
+	})
+}
@@ -0,0 +1,138 @@
+// filename.go
+//
+// Making safe file names from show IDs, dates and titles. Accented letters are spelled
+// out in ASCII, anything else outside [a-zA-Z0-9.-] becomes an underscore, and names
+// Windows reserves for devices are altered, so the same name works on every filesystem.
+
+package wmse
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// unsafeFilenameChars matches characters that are replaced in generated filenames
+var unsafeFilenameChars = regexp.MustCompile(`[^a-zA-Z0-9.-]`)
+
+// underscoreRuns matches the runs of underscores left where several characters were replaced
+var underscoreRuns = regexp.MustCompile(`_{2,}`)
+
+// unnamedFile is the name used when nothing of the original name survives
+const unnamedFile = "unnamed"
+
+// atomicTempPattern is added to a file's name for the temporary file it is rewritten
+// through; os.CreateTemp replaces the * with up to 10 digits
+const atomicTempPattern = ".*" + tempSuffix
+
+// reservedNameBytes is the most the program adds to the name of a download for the files
+// it writes beside it, so shortened names leave room for them. The longest is the
+// .meta.json sidecar while it is written through a temporary file; the .tmp.lock,
+// .tmp.size and .failed names are shorter.
+const reservedNameBytes = max(
+	len(tempSuffix+tempLockSuffix),
+	len(tempSuffix+partialSizeSuffix),
+	len(failedSuffix),
+	len(metaSidecarSuffix)-len(".mp3")+len(atomicTempPattern)-len("*")+10,
+)
+
+// transliterations spells common accented and ligature letters in plain ASCII
+var transliterations = strings.NewReplacer(
+	"à", "a", "á", "a", "â", "a", "ã", "a", "ä", "a", "å", "a", "ā", "a",
+	"À", "A", "Á", "A", "Â", "A", "Ã", "A", "Ä", "A", "Å", "A", "Ā", "A",
+	"æ", "ae", "Æ", "AE", "ç", "c", "Ç", "C", "č", "c", "Č", "C", "ć", "c", "Ć", "C",
+	"è", "e", "é", "e", "ê", "e", "ë", "e", "ē", "e", "ě", "e",
+	"È", "E", "É", "E", "Ê", "E", "Ë", "E", "Ē", "E", "Ě", "E",
+	"ì", "i", "í", "i", "î", "i", "ï", "i", "ī", "i",
+	"Ì", "I", "Í", "I", "Î", "I", "Ï", "I", "Ī", "I",
+	"ñ", "n", "Ñ", "N", "ń", "n", "Ń", "N", "ł", "l", "Ł", "L",
+	"ò", "o", "ó", "o", "ô", "o", "õ", "o", "ö", "o", "ø", "o", "ō", "o",
+	"Ò", "O", "Ó", "O", "Ô", "O", "Õ", "O", "Ö", "O", "Ø", "O", "Ō", "O",
+	"œ", "oe", "Œ", "OE", "ß", "ss", "š", "s", "Š", "S", "ś", "s", "Ś", "S",
+	"ù", "u", "ú", "u", "û", "u", "ü", "u", "ū", "u", "ů", "u",
+	"Ù", "U", "Ú", "U", "Û", "U", "Ü", "U", "Ū", "U", "Ů", "U",
+	"ý", "y", "ÿ", "y", "Ý", "Y", "ž", "z", "Ž", "Z", "ź", "z", "ż", "z", "Ź", "Z", "Ż", "Z",
+	"ð", "d", "Ð", "D", "þ", "th", "Þ", "TH", "ř", "r", "Ř", "R",
+)
+
+// reservedWindowsNames are device names Windows will not use as a file name, with or
+// without an extension
+var reservedWindowsNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// cleanPathComponent makes s safe as one component of a path. It returns "" if nothing
+// usable is left, for example when s is "..".
+func cleanPathComponent(s string) string {
+	s = transliterations.Replace(s)
+	s = unsafeFilenameChars.ReplaceAllString(s, "_")
+	s = underscoreRuns.ReplaceAllString(s, "_")
+	s = strings.Trim(s, ".")
+	if strings.Trim(s, "_") == "" {
+		return ""
+	}
+
+	stem, _, _ := strings.Cut(s, ".")
+	if reservedWindowsNames[strings.ToUpper(stem)] {
+		s = stem + "_" + s[len(stem):]
+	}
+	return s
+}
+
+// sanitizeFilename ensures the filename is safe for filesystem operations.
+// Names are shortened so that, with any of the suffixes in reservedNameBytes added, they fit
+// in maxLength bytes.
+func sanitizeFilename(filename string, maxLength int) string {
+	// Remove any directory traversal attempts, whichever separator they use
+	if i := strings.LastIndexAny(filename, `/\`); i >= 0 {
+		filename = filename[i+1:]
+	}
+
+	// Clean the name apart from the extension, which is kept as given
+	ext := ".mp3"
+	if strings.HasSuffix(strings.ToLower(filename), ext) {
+		ext = filename[len(filename)-len(ext):]
+		filename = filename[:len(filename)-len(ext)]
+	}
+	filename = cleanPathComponent(filename)
+	if filename == "" {
+		filename = unnamedFile
+	}
+	filename += ext
+
+	if maxLength > 0 {
+		filename = truncateFilename(filename, maxLength-reservedNameBytes)
+	}
+
+	return filename
+}
+
+// truncateFilename shortens name to at most maxLength bytes without splitting a rune. The extension
+// is kept and a short hash of the full name is added so distinct long names stay distinct.
+func truncateFilename(name string, maxLength int) string {
+	if len(name) <= maxLength {
+		return name
+	}
+
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	sum := sha256.Sum256([]byte(name))
+	suffix := "~" + hex.EncodeToString(sum[:4]) + ext
+
+	keep := maxLength - len(suffix)
+	if keep < 0 {
+		keep = 0
+	}
+	for keep > 0 && !utf8.RuneStart(base[keep]) {
+		keep--
+	}
+
+	return base[:keep] + suffix
+}
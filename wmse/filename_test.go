@@ -0,0 +1,83 @@
+package wmse
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "2024-01-01_ded.mp3", "2024-01-01_ded.mp3"},
+		{"reserved name", "CON.mp3", "CON_.mp3"},
+		{"reserved name without extension", "con", "con_.mp3"},
+		{"reserved name with inner extension", "nul.txt.mp3", "nul_.txt.mp3"},
+		{"reserved name keeps extension case", "Com1.MP3", "Com1_.MP3"},
+		{"parent directories", "../../etc/passwd", "passwd.mp3"},
+		{"mixed separators", `a/b\c.mp3`, "c.mp3"},
+		{"only dots", "..", "unnamed.mp3"},
+		{"control characters", "show\x00name\n\t.mp3", "show_name_.mp3"},
+		{"only control characters", "\x7f\x01.mp3", "unnamed.mp3"},
+		{"accented letters", "é ça.mp3", "e_ca.mp3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeFilename(tt.in, 255); got != tt.want {
+				t.Errorf("sanitizeFilename(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeFilenameLeavesRoomForSuffixes(t *testing.T) {
+	got := sanitizeFilename(strings.Repeat("a", 300)+".mp3", 100)
+	if len(got)+reservedNameBytes > 100 {
+		t.Errorf("%q is %d bytes, leaving no room for a %d byte suffix within 100", got, len(got), reservedNameBytes)
+	}
+	if !strings.HasSuffix(got, ".mp3") {
+		t.Errorf("%q lost its extension", got)
+	}
+}
+
+func TestTruncateFilename(t *testing.T) {
+	// 40 one-byte runes then two-byte ones, so some limits fall inside a rune
+	mixed := strings.Repeat("a", 40) + strings.Repeat("é", 20) + ".mp3"
+	tests := []struct {
+		name      string
+		in        string
+		maxLength int
+	}{
+		{"limit between runes", mixed, 59},
+		{"limit inside a rune", mixed, 60},
+		{"limit inside the first multi-byte rune", mixed, 54},
+		{"four-byte runes", strings.Repeat("🎵", 30) + ".mp3", 50},
+		{"long extension", strings.Repeat("b", 80) + ".flac", 40},
+		{"limit shorter than the suffix", strings.Repeat("c", 80) + ".mp3", 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateFilename(tt.in, tt.maxLength)
+			if !utf8.ValidString(got) {
+				t.Errorf("%q splits a rune", got)
+			}
+			if ext := filepath.Ext(tt.in); !strings.HasSuffix(got, ext) {
+				t.Errorf("%q lost the extension %s", got, ext)
+			}
+			if len(got) > tt.maxLength && tt.maxLength >= len("~00000000")+len(filepath.Ext(tt.in)) {
+				t.Errorf("%q is %d bytes, over the limit of %d", got, len(got), tt.maxLength)
+			}
+		})
+	}
+
+	if got := truncateFilename("short.mp3", 40); got != "short.mp3" {
+		t.Errorf("short name changed to %q", got)
+	}
+	if a, b := truncateFilename(mixed+"x.mp3", 50), truncateFilename(mixed+"y.mp3", 50); a == b {
+		t.Errorf("distinct long names both shortened to %q", a)
+	}
+}
@@ -0,0 +1,56 @@
+// htmlcheck.go
+//
+// Support for -verify-html-structure. The downloader depends on scraping the
+// <wmse-archive show-id="..."> element from a program page, so this check fetches a page
+// and says clearly whether that markup is still there.
+
+package wmse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"golang.org/x/net/html"
+)
+
+// ErrMarkupChanged is returned when a program page no longer has the expected markup
+var ErrMarkupChanged = errors.New("WMSE page markup appears to have changed")
+
+// countElements returns the number of elements named tag in the tree rooted at n
+func countElements(n *html.Node, tag string) int {
+	count := 0
+	if n.Type == html.ElementNode && n.Data == tag {
+		count++
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		count += countElements(c, tag)
+	}
+	return count
+}
+
+// verifyHTMLStructure fetches the program page for showID and checks that it still
+// contains a wmse-archive element carrying a show-id attribute
+func verifyHTMLStructure(ctx context.Context, client HTTPClient, site, showID string) error {
+	page, err := fetchProgramPage(ctx, client, site, showID)
+	if err != nil {
+		return err
+	}
+	doc := page.Doc
+
+	elements := countElements(doc, "wmse-archive")
+	if elements == 0 {
+		return fmt.Errorf("%w: no <wmse-archive> element found", ErrMarkupChanged)
+	}
+
+	archiveID := findArchiveID(doc)
+	if archiveID == "" {
+		return fmt.Errorf("%w: <wmse-archive> element has no show-id attribute", ErrMarkupChanged)
+	}
+
+	slog.Default().Debug("Program page structure",
+		"wmse_archive_elements", elements,
+		"archive_id", archiveID)
+	return nil
+}
@@ -0,0 +1,233 @@
+// id3.go
+//
+// Support for -tags, which writes the show details and the playlist into each MP3 as an
+// ID3v2.4 tag instead of a separate playlist file, and of -chapters, which adds the
+// chapter frames built in chapters.go. Frames from a tag the file already
+// carries are kept unless they are replaced.
+
+package wmse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// id3Frame is one frame of an ID3v2 tag
+type id3Frame struct {
+	id   string
+	data []byte
+}
+
+// replacedID3Frames are existing frames dropped because writeID3Tags writes its own.
+// TYER and TDAT are the ID3v2.3 equivalents of TDRC.
+var replacedID3Frames = map[string]bool{
+	"TIT2": true,
+	"TALB": true,
+	"TDRC": true,
+	"TYER": true,
+	"TDAT": true,
+	"COMM": true,
+	"WOAF": true,
+	"WORS": true,
+}
+
+// synchsafe encodes n in the 7-bits-per-byte form ID3v2 uses for sizes
+func synchsafe(n int) []byte {
+	return []byte{byte(n>>21) & 0x7f, byte(n>>14) & 0x7f, byte(n>>7) & 0x7f, byte(n) & 0x7f}
+}
+
+// unsynchsafe decodes a 4-byte synchsafe integer
+func unsynchsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+// id3TextFrame builds a UTF-8 text frame
+func id3TextFrame(id, text string) id3Frame {
+	return id3Frame{id: id, data: append([]byte{0x03}, text...)}
+}
+
+// id3URLFrame builds a URL link frame. URLs are ASCII, so the text needs no encoding byte.
+func id3URLFrame(id, url string) id3Frame {
+	return id3Frame{id: id, data: []byte(url)}
+}
+
+// id3CommentFrame builds a UTF-8 COMM frame with the given short description
+func id3CommentFrame(description, text string) id3Frame {
+	data := []byte{0x03}
+	data = append(data, "eng"...)
+	data = append(data, description...)
+	data = append(data, 0)
+	data = append(data, text...)
+	return id3Frame{id: "COMM", data: data}
+}
+
+// parseID3Frames returns the frames of the ID3v2.3 or v2.4 tag in tag, which starts with
+// the 10-byte header. Tags it cannot safely reuse (other versions, unsynchronised tags,
+// compressed or encrypted frames) yield no frames, so they are replaced outright.
+func parseID3Frames(tag []byte) []id3Frame {
+	major, flags := tag[3], tag[5]
+	if (major != 3 && major != 4) || flags&0x80 != 0 {
+		return nil
+	}
+
+	body := tag[10:]
+	if flags&0x40 != 0 { // Extended header
+		if len(body) < 4 {
+			return nil
+		}
+		size := int(binary.BigEndian.Uint32(body[:4])) + 4
+		if major == 4 {
+			size = unsynchsafe(body[:4])
+		}
+		if size > len(body) {
+			return nil
+		}
+		body = body[size:]
+	}
+
+	var frames []id3Frame
+	for len(body) >= 10 && body[0] != 0 {
+		id := string(body[:4])
+		size := int(binary.BigEndian.Uint32(body[4:8]))
+		if major == 4 {
+			size = unsynchsafe(body[4:8])
+		}
+		frameFlags := body[9]
+		if size > len(body)-10 {
+			break
+		}
+		data := body[10 : 10+size]
+		body = body[10+size:]
+
+		// Compressed, encrypted or otherwise transformed frames can't be copied across versions
+		transformed := frameFlags&0xc0 != 0
+		if major == 4 {
+			transformed = frameFlags&0x0f != 0
+		}
+		if transformed || replacedID3Frames[id] {
+			continue
+		}
+		frames = append(frames, id3Frame{id: id, data: data})
+	}
+	return frames
+}
+
+// encodeID3Frames encodes frames in ID3v2.4 form, as in a tag body or a CHAP frame
+func encodeID3Frames(frames []id3Frame) []byte {
+	var body bytes.Buffer
+	for _, f := range frames {
+		body.WriteString(f.id)
+		body.Write(synchsafe(len(f.data)))
+		body.Write([]byte{0, 0})
+		body.Write(f.data)
+	}
+	return body.Bytes()
+}
+
+// encodeID3Tag builds an ID3v2.4 tag holding frames
+func encodeID3Tag(frames []id3Frame) []byte {
+	body := encodeID3Frames(frames)
+	tag := []byte{'I', 'D', '3', 4, 0, 0}
+	tag = append(tag, synchsafe(len(body))...)
+	return append(tag, body...)
+}
+
+// writeID3Tags writes the show name, date, playlist and chapters into the MP3 at path as an
+// ID3v2.4 tag; an empty playlist or no chapters leaves that part out. The archive URL and
+// station's website are recorded as well, so the file says where it came from. An existing
+// ID3v2 tag is replaced, keeping the frames this does not set. The file is rewritten through
+// a temporary file and a rename so it is never left half-tagged. The date is read in loc,
+// the station's time zone.
+func writeID3Tags(path string, archive Archive, playlist string, chapters []chapter, station string, loc *time.Location) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// Find the end of any existing tag; the audio that follows is copied unchanged
+	header := make([]byte, 10)
+	n, err := io.ReadFull(in, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return fmt.Errorf("could not read %s: %w", path, err)
+	}
+	var frames []id3Frame
+	audioStart := int64(0)
+	if size := id3v2Size(header[:n]); size > 0 {
+		tag := make([]byte, size)
+		if _, err := in.ReadAt(tag, 0); err != nil {
+			return fmt.Errorf("could not read existing ID3 tag: %w", err)
+		}
+		frames = parseID3Frames(tag)
+		audioStart = int64(size)
+	}
+
+	// The show's name is preferred; the API does not always give one, unlike its ID
+	show := archive.Name
+	if show == "" {
+		show = archive.ShowID
+	}
+	title := archive.Title
+	if title == "" {
+		title = fmt.Sprintf("%s %s", show, archive.PlaylistDate)
+	}
+	date := archive.PlaylistDate
+	if t, err := archiveDateIn(archive, loc); err == nil {
+		date = t.Format("2006-01-02")
+	}
+	frames = append(frames,
+		id3TextFrame("TIT2", title),
+		id3TextFrame("TALB", show),
+		id3TextFrame("TDRC", date),
+	)
+	if archive.ArchiveURL != "" {
+		frames = append(frames, id3URLFrame("WOAF", archive.ArchiveURL))
+	}
+	if station != "" {
+		frames = append(frames, id3URLFrame("WORS", station))
+	}
+	if playlist != "" {
+		frames = append(frames, id3CommentFrame("Playlist", playlist))
+	}
+	if len(chapters) > 0 {
+		frames = slices.DeleteFunc(frames, func(f id3Frame) bool { return f.id == "CHAP" || f.id == "CTOC" })
+		frames = append(frames, chapterFrames(chapters)...)
+	}
+
+	out, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+atomicTempPattern)
+	if err != nil {
+		return err
+	}
+	tmpPath := out.Name()
+
+	_, err = out.Write(encodeID3Tag(frames))
+	if err == nil {
+		_, err = io.Copy(out, io.NewSectionReader(in, audioStart, 1<<62))
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("could not write ID3 tags to %s: %w", path, err)
+	}
+
+	slog.Default().Debug("Wrote ID3 tags", "path", path, "frames", len(frames))
+	return nil
+}
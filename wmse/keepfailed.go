@@ -0,0 +1,46 @@
+// keepfailed.go
+//
+// Support for -keep-failed. A download rejected for its content type or size is normally
+// thrown away; with -keep-failed what the server sent is kept next to where the MP3 would
+// have gone, as <name>.failed, so it can be inspected. Each failure replaces the last one.
+
+package wmse
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// failedSuffix is added to the final name of a download to name its kept failed response
+const failedSuffix = ".failed"
+
+// keepFailedFile moves the rejected download at path aside for inspection
+func keepFailedFile(path, outputPath string) error {
+	kept := outputPath + failedSuffix
+	if err := os.Rename(path, kept); err != nil {
+		return fmt.Errorf("could not keep failed download: %w", err)
+	}
+	slog.Default().Warn("Kept failed download for inspection", "path", kept)
+	return nil
+}
+
+// keepFailedResponse saves body, a response rejected before it was written, for inspection.
+// Only the first maxResponseSize bytes are kept.
+func keepFailedResponse(body io.Reader, outputPath string) error {
+	kept := outputPath + failedSuffix
+	f, err := os.Create(kept)
+	if err != nil {
+		return fmt.Errorf("could not keep failed response: %w", err)
+	}
+	_, err = io.Copy(f, io.LimitReader(body, maxResponseSize))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not keep failed response: %w", err)
+	}
+	slog.Default().Warn("Kept failed response for inspection", "path", kept)
+	return nil
+}
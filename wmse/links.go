@@ -0,0 +1,172 @@
+// links.go
+//
+// Support for -fetch-links, which downloads supplementary resources (track pages, cover
+// art, show notes) referenced from an episode's playlist into a folder next to the MP3.
+
+package wmse
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	// maxLinksPerEpisode is the maximum number of linked resources fetched for one episode
+	maxLinksPerEpisode = 25
+	// maxLinkBytesPerEpisode is the maximum total size of linked resources for one episode (50MB)
+	maxLinkBytesPerEpisode = 50 * 1024 * 1024
+)
+
+// findLinks returns every http(s) URL found in the string values of a JSON document
+func findLinks(raw json.RawMessage) []string {
+	var doc any
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil
+	}
+
+	var links []string
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case string:
+			if u, err := url.Parse(v); err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+				links = append(links, u.String())
+			}
+		case []any:
+			for _, item := range v {
+				walk(item)
+			}
+		case map[string]any:
+			for _, key := range slices.Sorted(maps.Keys(v)) {
+				walk(v[key])
+			}
+		}
+	}
+	walk(doc)
+
+	return links
+}
+
+// linkFilename builds a safe local name for the i-th link of an episode
+func linkFilename(i int, link string) string {
+	name := "link"
+	if u, err := url.Parse(link); err == nil {
+		if base := path.Base(u.Path); base != "/" && base != "." {
+			name = base
+		}
+	}
+	name = unsafeFilenameChars.ReplaceAllString(name, "_")
+	return fmt.Sprintf("%02d_%s", i+1, name)
+}
+
+// fetchLinks downloads links into dir, stopping at the per-episode count and size limits.
+// Links left out by the limits are logged, not treated as failures. Failures of individual
+// links are logged and do not stop the others; an error is returned afterwards if any link
+// that was tried could not be fetched.
+func fetchLinks(ctx context.Context, client HTTPClient, links []string, dir string) error {
+	logger := slog.Default()
+	if len(links) == 0 {
+		return nil
+	}
+	if len(links) > maxLinksPerEpisode {
+		logger.Warn("Too many playlist links, fetching only the first ones",
+			"found", len(links),
+			"limit", maxLinksPerEpisode)
+		links = links[:maxLinksPerEpisode]
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("could not create links directory: %w", err)
+	}
+
+	var budget int64 = maxLinkBytesPerEpisode
+	failed := 0
+	for i, link := range links {
+		if budget <= 0 {
+			logger.Warn("Playlist link size limit reached, skipping the rest",
+				"dir", dir,
+				"remaining", len(links)-i)
+			break
+		}
+
+		written, err := fetchLink(ctx, client, link, filepath.Join(dir, linkFilename(i, link)), budget)
+		budget -= written
+		if errors.Is(err, ErrFileTooLarge) {
+			logger.Warn("Playlist link size limit reached, skipping the rest",
+				"dir", dir,
+				"url", link,
+				"remaining", len(links)-i)
+			break
+		}
+		if err != nil {
+			logger.Warn("Failed to fetch playlist link",
+				"url", link,
+				"error", err)
+			failed++
+			continue
+		}
+		logger.Debug("Fetched playlist link",
+			"url", link,
+			"bytes", written)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to fetch %d playlist links", failed)
+	}
+	return nil
+}
+
+// fetchLink downloads one link to dest, writing at most limit bytes
+func fetchLink(ctx context.Context, client HTTPClient, link, dest string, limit int64) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", link, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.4 Safari/605.1.15")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to GET %s: %w", link, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("bad status fetching %s: %s", link, resp.Status)
+	}
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return 0, fmt.Errorf("could not create %s: %w", dest, err)
+	}
+
+	written, err := io.Copy(out, io.LimitReader(resp.Body, limit+1))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && written > limit {
+		err = ErrFileTooLarge
+	}
+	if err != nil {
+		os.Remove(dest)
+		return written, fmt.Errorf("error writing %s: %w", dest, err)
+	}
+
+	return written, nil
+}
+
+// linksDir returns the folder that holds an episode's linked resources
+func linksDir(outputPath string) string {
+	return strings.TrimSuffix(outputPath, ".mp3") + "_links"
+}
@@ -0,0 +1,138 @@
+// m3u.go
+//
+// Support for -m3u, which keeps an extended M3U playlist of the episodes in the output
+// directory, in broadcast order, so a whole run of a show can be loaded into a player.
+// Each entry carries its air date in a comment line, which players ignore, so the order
+// survives rewrites whatever -template the files were named with.
+
+package wmse
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// m3uDatePrefix starts the comment line holding the air date of the entry that follows
+const m3uDatePrefix = "#WMSE-DATE:"
+
+// m3uEntry is one episode listed in an M3U playlist
+type m3uEntry struct {
+	file  string // File name, relative to the playlist
+	title string // Text shown by the player
+	date  time.Time
+}
+
+// newM3UEntry describes a downloaded archive saved as file, dating it in loc
+func newM3UEntry(archive Archive, file string, loc *time.Location) m3uEntry {
+	entry := m3uEntry{file: file, title: fmt.Sprintf("%s - %s", archive.ShowID, archive.PlaylistDate)}
+	if archive.Title != "" {
+		entry.title = fmt.Sprintf("%s - %s", archive.ShowID, archive.Title)
+	}
+	entry.date, _ = archiveDateIn(archive, loc)
+	return entry
+}
+
+// readM3U returns the entries of an existing playlist, or none if it does not exist. Entries
+// without a date line, written by older versions, are dated by a <date>_ file name prefix
+// read in loc.
+func readM3U(path string, loc *time.Location) ([]m3uEntry, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []m3uEntry
+	var title string
+	var date time.Time
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXTINF:"):
+			if _, t, ok := strings.Cut(line, ","); ok {
+				title = t
+			}
+		case strings.HasPrefix(line, m3uDatePrefix):
+			if t, err := time.Parse(time.RFC3339, strings.TrimPrefix(line, m3uDatePrefix)); err == nil {
+				date = t.In(loc)
+			}
+		case strings.HasPrefix(line, "#"):
+		default:
+			entry := m3uEntry{file: line, title: title, date: date}
+			if entry.date.IsZero() {
+				// Default episode file names are <date>_<show>.mp3
+				if prefix, _, ok := strings.Cut(filepath.Base(line), "_"); ok {
+					entry.date, _ = parsePlaylistDate(prefix, loc)
+				}
+			}
+			entries = append(entries, entry)
+			title = ""
+			date = time.Time{}
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// updateM3U merges fresh into the playlist at path and rewrites it in date order. Entries
+// whose files have gone are dropped; a file already listed keeps a single entry.
+func updateM3U(path string, fresh []m3uEntry, loc *time.Location) error {
+	existing, err := readM3U(path, loc)
+	if err != nil {
+		return fmt.Errorf("could not read playlist %s: %w", path, err)
+	}
+
+	dir := filepath.Dir(path)
+	byFile := make(map[string]m3uEntry)
+	for _, entry := range existing {
+		if _, err := os.Stat(filepath.Join(dir, entry.file)); err == nil {
+			byFile[entry.file] = entry
+		}
+	}
+	for _, entry := range fresh {
+		byFile[entry.file] = entry
+	}
+
+	entries := make([]m3uEntry, 0, len(byFile))
+	for _, entry := range byFile {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].date.Equal(entries[j].date) {
+			return entries[i].date.Before(entries[j].date)
+		}
+		return entries[i].file < entries[j].file
+	})
+
+	var sb strings.Builder
+	sb.WriteString("#EXTM3U\n")
+	for _, entry := range entries {
+		if !entry.date.IsZero() {
+			fmt.Fprintf(&sb, "%s%s\n", m3uDatePrefix, entry.date.Format(time.RFC3339))
+		}
+		fmt.Fprintf(&sb, "#EXTINF:-1,%s\n%s\n", entry.title, entry.file)
+	}
+	if err := writeFileAtomic(path, []byte(sb.String()), 0644); err != nil {
+		return fmt.Errorf("could not write playlist %s: %w", path, err)
+	}
+
+	slog.Default().Info("Updated M3U playlist",
+		"path", path,
+		"added", len(fresh),
+		"entries", len(entries))
+	return nil
+}
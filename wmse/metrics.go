@@ -0,0 +1,111 @@
+// metrics.go
+//
+// Support for -metrics-addr, which serves live counters for the run in the Prometheus text
+// format: archives attempted, downloaded, failed and skipped, bytes received, and a
+// histogram of how long each download took. They are updated as each archive finishes, and
+// bytes as they arrive, so a long run can be scraped while it is going.
+
+package wmse
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the download duration histogram
+var durationBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200, 1800}
+
+// runMetrics counts what the downloads of a run have done so far
+type runMetrics struct {
+	attempted atomic.Int64
+	succeeded atomic.Int64
+	failed    atomic.Int64
+	skipped   atomic.Int64
+	bytes     atomic.Int64
+
+	mu      sync.Mutex
+	buckets []int64 // Downloads no longer than each of durationBuckets
+	count   int64
+	sum     float64 // Total seconds
+}
+
+// newRunMetrics returns metrics with every counter at zero
+func newRunMetrics() *runMetrics {
+	return &runMetrics{buckets: make([]int64, len(durationBuckets))}
+}
+
+// record counts the outcome of one archive, which took elapsed. Only completed downloads
+// are added to the duration histogram.
+func (m *runMetrics) record(outcome Outcome, elapsed time.Duration) {
+	m.attempted.Add(1)
+	switch {
+	case outcome.Err == nil && outcome.Skipped, outcome.Benign:
+		m.skipped.Add(1)
+		return
+	case outcome.Err != nil:
+		m.failed.Add(1)
+		return
+	}
+	m.succeeded.Add(1)
+
+	seconds := elapsed.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			m.buckets[i]++
+		}
+	}
+	m.count++
+	m.sum += seconds
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format
+func (m *runMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	counters := []struct {
+		name, help string
+		value      int64
+	}{
+		{"wmse_downloads_attempted_total", "Archives processed, whatever the outcome.", m.attempted.Load()},
+		{"wmse_downloads_succeeded_total", "Archives downloaded.", m.succeeded.Load()},
+		{"wmse_downloads_failed_total", "Archives that failed to download.", m.failed.Load()},
+		{"wmse_downloads_skipped_total", "Archives skipped, usually because they were already present.", m.skipped.Load()},
+		{"wmse_bytes_downloaded_total", "Bytes of audio received.", m.bytes.Load()},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.value)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	const histogram = "wmse_download_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Time taken by each completed download.\n# TYPE %s histogram\n", histogram, histogram)
+	for i, bound := range durationBuckets {
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", histogram, strconv.FormatFloat(bound, 'f', -1, 64), m.buckets[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", histogram, m.count)
+	fmt.Fprintf(w, "%s_sum %s\n", histogram, strconv.FormatFloat(m.sum, 'f', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", histogram, m.count)
+}
+
+// startMetricsServer serves m at /metrics on addr in the background
+func startMetricsServer(addr string, m *runMetrics) {
+	logger := slog.Default()
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil {
+			logger.Error("Metrics server stopped", "addr", addr, "error", err)
+		}
+	}()
+	logger.Info("Serving metrics", "addr", addr, "path", "/metrics")
+}
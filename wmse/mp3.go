@@ -0,0 +1,162 @@
+// mp3.go
+//
+// Minimal MPEG audio frame parsing, used to work out how long an MP3 file plays for
+// without pulling in a full decoder.
+
+package wmse
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNoMP3Frames is returned when a stream contains no recognisable MPEG audio frames
+var ErrNoMP3Frames = errors.New("no MP3 frames found")
+
+// Bitrate tables in kbps, indexed by the 4-bit bitrate index of a frame header
+var (
+	mpeg1Layer1Bitrates  = [16]int{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, 0}
+	mpeg1Layer2Bitrates  = [16]int{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 0}
+	mpeg1Layer3Bitrates  = [16]int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0}
+	mpeg2Layer1Bitrates  = [16]int{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, 0}
+	mpeg2Layer23Bitrates = [16]int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0}
+)
+
+// Sample rate tables in Hz, indexed by the 2-bit sample rate index of a frame header
+var (
+	mpeg1SampleRates  = [3]int{44100, 48000, 32000}
+	mpeg2SampleRates  = [3]int{22050, 24000, 16000}
+	mpeg25SampleRates = [3]int{11025, 12000, 8000}
+)
+
+// mp3Frame holds the fields of an MPEG audio frame header needed for timing
+type mp3Frame struct {
+	length     int // Length of the whole frame in bytes, header included
+	samples    int // Number of audio samples in the frame
+	sampleRate int // Sample rate in Hz
+}
+
+// parseMP3Frame decodes a 4-byte MPEG audio frame header
+func parseMP3Frame(h []byte) (mp3Frame, bool) {
+	if len(h) < 4 || h[0] != 0xFF || h[1]&0xE0 != 0xE0 {
+		return mp3Frame{}, false
+	}
+
+	version := (h[1] >> 3) & 0x03 // 0: MPEG 2.5, 1: reserved, 2: MPEG 2, 3: MPEG 1
+	layer := (h[1] >> 1) & 0x03   // 0: reserved, 1: Layer III, 2: Layer II, 3: Layer I
+	bitrateIndex := h[2] >> 4
+	sampleRateIndex := (h[2] >> 2) & 0x03
+	padding := int((h[2] >> 1) & 0x01)
+
+	if version == 1 || layer == 0 || bitrateIndex == 0 || bitrateIndex == 15 || sampleRateIndex == 3 {
+		return mp3Frame{}, false
+	}
+
+	var bitrate, sampleRate, samples int
+	switch version {
+	case 3:
+		sampleRate = mpeg1SampleRates[sampleRateIndex]
+		switch layer {
+		case 3:
+			bitrate, samples = mpeg1Layer1Bitrates[bitrateIndex], 384
+		case 2:
+			bitrate, samples = mpeg1Layer2Bitrates[bitrateIndex], 1152
+		default:
+			bitrate, samples = mpeg1Layer3Bitrates[bitrateIndex], 1152
+		}
+	default:
+		if version == 2 {
+			sampleRate = mpeg2SampleRates[sampleRateIndex]
+		} else {
+			sampleRate = mpeg25SampleRates[sampleRateIndex]
+		}
+		switch layer {
+		case 3:
+			bitrate, samples = mpeg2Layer1Bitrates[bitrateIndex], 384
+		case 2:
+			bitrate, samples = mpeg2Layer23Bitrates[bitrateIndex], 1152
+		default:
+			bitrate, samples = mpeg2Layer23Bitrates[bitrateIndex], 576
+		}
+	}
+
+	bitrate *= 1000
+	var length int
+	if layer == 3 {
+		length = (12*bitrate/sampleRate + padding) * 4
+	} else {
+		length = samples/8*bitrate/sampleRate + padding
+	}
+
+	return mp3Frame{length: length, samples: samples, sampleRate: sampleRate}, true
+}
+
+// id3v2Size returns the total size of an ID3v2 tag starting at h, or 0 if h is not an ID3v2 header
+func id3v2Size(h []byte) int {
+	if len(h) < 10 || string(h[:3]) != "ID3" {
+		return 0
+	}
+	size := int(h[6]&0x7f)<<21 | int(h[7]&0x7f)<<14 | int(h[8]&0x7f)<<7 | int(h[9]&0x7f)
+	size += 10
+	if h[5]&0x10 != 0 { // Footer present
+		size += 10
+	}
+	return size
+}
+
+// looksLikeMP3 reports whether h, the first bytes of a file, starts with an ID3v2 tag or
+// an MPEG audio frame header
+func looksLikeMP3(h []byte) bool {
+	if id3v2Size(h) > 0 {
+		return true
+	}
+	_, ok := parseMP3Frame(h)
+	return ok
+}
+
+// mp3Duration returns the playing time of the MP3 stream in r by walking its frame headers.
+// Bytes that are not part of a valid frame (tags, junk) are skipped.
+func mp3Duration(r io.Reader) (time.Duration, error) {
+	br := bufio.NewReaderSize(r, 64*1024)
+
+	// Skip a leading ID3v2 tag
+	if h, _ := br.Peek(10); id3v2Size(h) > 0 {
+		if _, err := br.Discard(id3v2Size(h)); err != nil {
+			return 0, ErrNoMP3Frames
+		}
+	}
+
+	var seconds float64
+	frames := 0
+	for {
+		h, err := br.Peek(4)
+		if len(h) < 4 {
+			if err != nil && err != io.EOF {
+				return 0, err
+			}
+			break
+		}
+
+		frame, ok := parseMP3Frame(h)
+		if !ok {
+			// Resynchronise one byte at a time
+			br.Discard(1)
+			continue
+		}
+
+		if _, err := br.Discard(frame.length); err != nil {
+			// Truncated final frame
+			break
+		}
+		seconds += float64(frame.samples) / float64(frame.sampleRate)
+		frames++
+	}
+
+	if frames == 0 {
+		return 0, ErrNoMP3Frames
+	}
+
+	return time.Duration(seconds * float64(time.Second)), nil
+}
@@ -0,0 +1,30 @@
+// mtime.go
+//
+// Support for -set-mtime, which dates each downloaded MP3 by when the show aired, so sorting
+// by date in a file browser matches the broadcast order. Archives without a usable date get
+// the server's Last-Modified time instead, and are left alone if there is neither.
+
+package wmse
+
+import (
+	"os"
+	"time"
+)
+
+// archiveFileTime returns the time to give the saved file of archive: its air date, or
+// failing that modified, the server's Last-Modified time. The zero time means neither is known.
+func archiveFileTime(archive Archive, modified time.Time, loc *time.Location) time.Time {
+	if date, err := archiveDateIn(archive, loc); err == nil {
+		return date
+	}
+	return modified
+}
+
+// setFileTime sets the access and modification times of path to t. A zero t leaves the
+// file as it is.
+func setFileTime(path string, t time.Time) error {
+	if t.IsZero() {
+		return nil
+	}
+	return os.Chtimes(path, t, t)
+}
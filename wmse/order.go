@@ -0,0 +1,101 @@
+// order.go
+//
+// Ordering archives by playlist date. The API lists archives in no particular order, so
+// they are sorted before downloading (-order), -limit keeps only the newest few and
+// -since-last-run only those newer than anything already downloaded.
+// Archives whose date cannot be parsed always go last, in the order they were listed.
+
+package wmse
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ArchiveOrders lists the values accepted by SortArchives: newest first or oldest first
+var ArchiveOrders = []string{"desc", "asc"}
+
+// archiveDate returns the playlist date of archive, and false if it cannot be parsed
+func archiveDate(archive Archive) (time.Time, bool) {
+	date, err := archive.ParsedDate()
+	return date, err == nil
+}
+
+// dateOrder returns the indices of archives sorted by playlist date, newest first if
+// newest is set and oldest first otherwise, with undated archives at the end
+func dateOrder(archives []Archive, newest bool) []int {
+	dates := make([]time.Time, len(archives))
+	dated := make([]bool, len(archives))
+	order := make([]int, len(archives))
+	for i, archive := range archives {
+		dates[i], dated[i] = archiveDate(archive)
+		order[i] = i
+	}
+
+	slices.SortStableFunc(order, func(a, b int) int {
+		switch {
+		case !dated[a] || !dated[b]:
+			return boolOrder(dated[b]) - boolOrder(dated[a])
+		case newest:
+			return dates[b].Compare(dates[a])
+		default:
+			return dates[a].Compare(dates[b])
+		}
+	})
+	return order
+}
+
+// sortByDate returns a copy of archives sorted by playlist date
+func sortByDate(archives []Archive, newest bool) []Archive {
+	sorted := make([]Archive, 0, len(archives))
+	for _, i := range dateOrder(archives, newest) {
+		sorted = append(sorted, archives[i])
+	}
+	return sorted
+}
+
+// boolOrder is 1 for true and 0 for false
+func boolOrder(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// SortArchives returns a copy of archives sorted by playlist date in order, one of
+// ArchiveOrders
+func SortArchives(archives []Archive, order string) ([]Archive, error) {
+	switch order {
+	case "desc":
+		return sortByDate(archives, true), nil
+	case "asc":
+		return sortByDate(archives, false), nil
+	default:
+		return nil, fmt.Errorf("unknown order %q (want one of %s)", order, strings.Join(ArchiveOrders, ", "))
+	}
+}
+
+// LimitArchives returns the n most recent archives, newest first. An n of zero or less
+// means no limit, and archives is returned unchanged.
+func LimitArchives(archives []Archive, n int) []Archive {
+	if n <= 0 {
+		return archives
+	}
+	sorted := sortByDate(archives, true)
+	return sorted[:min(n, len(sorted))]
+}
+
+// ArchivesAfter returns the archives dated after cutoff. Dates are compared as instants, so
+// dates given with different offsets line up. Undated archives are kept, since there is no
+// telling whether they are new.
+func ArchivesAfter(archives []Archive, cutoff time.Time) []Archive {
+	var kept []Archive
+	for _, archive := range archives {
+		if date, ok := archiveDate(archive); !ok || date.After(cutoff) {
+			kept = append(kept, archive)
+		}
+	}
+	return kept
+}
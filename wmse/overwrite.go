@@ -0,0 +1,73 @@
+// overwrite.go
+//
+// Support for -overwrite, which decides what happens to an archive that is already
+// downloaded: "never" keeps it, "always" downloads it again, and "if-different" asks the
+// server with a HEAD request and downloads again only if the archive was re-uploaded.
+
+package wmse
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// OverwriteModes lists the values accepted for Options.Overwrite
+var OverwriteModes = []string{"never", "always", "if-different"}
+
+// overwriteIfDifferent is the mode that compares an existing file with the server's copy
+const overwriteIfDifferent = "if-different"
+
+// keepExisting reports whether the download of archive already at path should be kept. It
+// is always kept unless opts.Overwrite is if-different and the server's copy has a different
+// size or was modified after the file was written. A file whose tags were rewritten no longer
+// matches the server's size, so with -tags or -chapters only the date is compared. With
+// -set-mtime the file's own time is its air date, so the date is compared with when the
+// download was recorded instead, if it was. If the server cannot be asked, the file is kept.
+func (o downloadOptions) keepExisting(ctx context.Context, archive Archive, path string) bool {
+	if o.Overwrite != overwriteIfDifferent {
+		return true
+	}
+	logger := slog.Default()
+
+	local, err := os.Stat(path)
+	if err != nil {
+		logger.Info("Recorded download is missing, downloading again", "path", path)
+		return false
+	}
+	size, modified, err := headArchive(ctx, o.downloadClient(), archive.ArchiveURL)
+	if err != nil {
+		logger.Warn("Could not check archive for changes, keeping existing file",
+			"path", path,
+			"error", err)
+		return true
+	}
+
+	written := local.ModTime()
+	if o.SetMtime {
+		written = time.Time{}
+		if o.State != nil {
+			if entry, ok := o.State.lookup(archive); ok {
+				written = entry.Completed
+			}
+		}
+	}
+
+	var reason string
+	switch {
+	case size >= 0 && size != local.Size() && !o.Tags && !o.Chapters:
+		reason = "size"
+	case !modified.IsZero() && !written.IsZero() && modified.After(written):
+		reason = "modified"
+	default:
+		return true
+	}
+	logger.Info("Archive changed on the server, downloading again",
+		"path", path,
+		"reason", reason,
+		"remote_size", size,
+		"local_size", local.Size(),
+		"remote_modified", modified)
+	return false
+}
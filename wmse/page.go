@@ -0,0 +1,162 @@
+// page.go
+//
+// Support for -save-page, which keeps a copy of the show's program page (and optionally
+// a plain-text rendering of it) so the show description is archived with the audio.
+
+package wmse
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// skippedTextElements are elements whose content is not part of the readable page text
+var skippedTextElements = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"noscript": true,
+	"template": true,
+	"nav":      true,
+	"header":   true,
+	"footer":   true,
+	"form":     true,
+	"svg":      true,
+}
+
+// blockTextElements start a new line when the page is rendered as text
+var blockTextElements = map[string]bool{
+	"p": true, "div": true, "br": true, "li": true, "section": true, "article": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true, "tr": true,
+}
+
+// savePage writes the raw program page to dir, plus a text version when withText is set
+func savePage(page *programPage, showID, dir string, withText bool) error {
+	logger := slog.Default()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("could not create output directory: %w", err)
+	}
+
+	htmlPath := filepath.Join(dir, showID+"_program.html")
+	if err := writeFileAtomic(htmlPath, page.Raw, 0644); err != nil {
+		return fmt.Errorf("could not save program page: %w", err)
+	}
+	logger.Info("Saved program page", "path", htmlPath)
+
+	if !withText {
+		return nil
+	}
+
+	textPath := filepath.Join(dir, showID+"_program.txt")
+	if err := writeFileAtomic(textPath, []byte(pageText(page)), 0644); err != nil {
+		return fmt.Errorf("could not save program page text: %w", err)
+	}
+	logger.Info("Saved program page text", "path", textPath)
+
+	return nil
+}
+
+// pageText renders the readable content of a program page as plain text. The page's
+// meta description, if any, comes first, followed by the text of its main content.
+func pageText(page *programPage) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Source: %s\n\n", page.URL)
+
+	if desc := metaDescription(page.Doc); desc != "" {
+		sb.WriteString(desc)
+		sb.WriteString("\n\n")
+	}
+
+	root := firstElement(page.Doc, "main")
+	if root == nil {
+		root = firstElement(page.Doc, "article")
+	}
+	if root == nil {
+		root = page.Doc
+	}
+
+	var lines []string
+	var line strings.Builder
+	flush := func() {
+		if text := strings.Join(strings.Fields(line.String()), " "); text != "" {
+			lines = append(lines, text)
+		}
+		line.Reset()
+	}
+
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && skippedTextElements[n.Data] {
+			return
+		}
+		if n.Type == html.TextNode {
+			line.WriteString(n.Data)
+			line.WriteString(" ")
+		}
+		block := n.Type == html.ElementNode && blockTextElements[n.Data]
+		if block {
+			flush()
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+		if block {
+			flush()
+		}
+	}
+	walk(root)
+	flush()
+
+	sb.WriteString(strings.Join(lines, "\n"))
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+// metaDescription returns the content of the page's description or og:description meta tag
+func metaDescription(doc *html.Node) string {
+	var desc string
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if desc != "" {
+			return
+		}
+		if n.Type == html.ElementNode && n.Data == "meta" {
+			var name, content string
+			for _, attr := range n.Attr {
+				switch attr.Key {
+				case "name", "property":
+					name = attr.Val
+				case "content":
+					content = attr.Val
+				}
+			}
+			if name == "description" || name == "og:description" {
+				desc = strings.TrimSpace(content)
+				return
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	return desc
+}
+
+// firstElement returns the first element named tag in the tree rooted at n
+func firstElement(n *html.Node, tag string) *html.Node {
+	if n.Type == html.ElementNode && n.Data == tag {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if found := firstElement(c, tag); found != nil {
+			return found
+		}
+	}
+	return nil
+}
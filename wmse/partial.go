@@ -0,0 +1,77 @@
+// partial.go
+//
+// Checking that a partial download still belongs to the archive on the server. While a
+// .tmp file is written, the full size the server announced is kept next to it; when the
+// download is resumed, a server now reporting a different size means the archive was
+// replaced, so the partial is thrown away rather than joined to bytes of another version.
+//
+// It also finds the partials left under an output directory, for -resume-all.
+
+package wmse
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// partialSizeSuffix is appended to a temp file's name to form the record of its full size
+const partialSizeSuffix = ".size"
+
+// readPartialSize returns the full size recorded at path, or -1 if none was
+func readPartialSize(path string) int64 {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return -1
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || size < 0 {
+		return -1
+	}
+	return size
+}
+
+// FindPartials returns the temp files of unfinished MP3 downloads under dir and its
+// subdirectories. Empty temp files hold nothing to resume and are left out.
+func FindPartials(dir string) ([]string, error) {
+	var partials []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || !strings.HasSuffix(path, ".mp3"+tempSuffix) {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil && info.Size() > 0 {
+			partials = append(partials, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not search for partial downloads: %w", err)
+	}
+	return partials, nil
+}
+
+// partialArchives returns the archives whose temp file is in partials, matching them by the
+// name each would be saved under. Matched temp files are removed from partials.
+func partialArchives(archives []Archive, opts downloadOptions, partials map[string]bool) []Archive {
+	var found []Archive
+	for _, archive := range archives {
+		tempFile := filepath.Join(opts.OutputDir, opts.archiveFilename(archive)) + tempSuffix
+		if partials[tempFile] {
+			delete(partials, tempFile)
+			found = append(found, archive)
+		}
+	}
+	return found
+}
+
+// writePartialSize records size at path. It is only a safeguard, so a failure is ignored;
+// the resume then goes ahead unchecked, as it would have before.
+func writePartialSize(path string, size int64) {
+	os.WriteFile(path, []byte(strconv.FormatInt(size, 10)+"\n"), 0644)
+}
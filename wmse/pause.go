@@ -0,0 +1,67 @@
+// pause.go
+//
+// Pausing a run from outside. While a file named .pause exists in the output directory,
+// workers finish their current download and then wait; removing the file lets them carry
+// on with the rest of the queue.
+
+package wmse
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// pauseFileName is the control file that pauses a run while it exists
+	pauseFileName = ".pause"
+	// pausePollInterval is how often a paused run checks whether it may continue
+	pausePollInterval = 5 * time.Second
+)
+
+// pauseGate holds workers back while the pause file exists
+type pauseGate struct {
+	path   string
+	mu     sync.Mutex
+	paused bool
+}
+
+// newPauseGate returns a gate controlled by the pause file in dir
+func newPauseGate(dir string) *pauseGate {
+	return &pauseGate{path: filepath.Join(dir, pauseFileName)}
+}
+
+// wait returns once the pause file is absent, polling while it is present. It returns ctx's
+// error if ctx ends while the run is paused.
+func (g *pauseGate) wait(ctx context.Context) error {
+	ticker := time.NewTicker(pausePollInterval)
+	defer ticker.Stop()
+
+	for {
+		_, err := os.Stat(g.path)
+		present := err == nil
+
+		g.mu.Lock()
+		if present != g.paused {
+			g.paused = present
+			if present {
+				slog.Default().Info("Pausing downloads; remove the pause file to continue", "path", g.path)
+			} else {
+				slog.Default().Info("Resuming downloads")
+			}
+		}
+		g.mu.Unlock()
+
+		if !present {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
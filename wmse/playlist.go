@@ -0,0 +1,225 @@
+// playlist.go
+//
+// Playlist decoding and formatting. Tracks keep every field the API returns so that
+// a -playlist-template can use whatever WMSE provides (album, label, year, ...).
+
+package wmse
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// defaultPlaylistTemplate renders one track per line as "artist - title"
+const defaultPlaylistTemplate = "{{.artist}} - {{.title}}"
+
+// PlaylistFormats lists the values accepted for Options.PlaylistFormat
+var PlaylistFormats = []string{"txt", "json", "csv"}
+
+// Track is one playlist entry. Every field returned by the API is kept, keyed by its
+// JSON name; numbers are kept in their JSON form, nested values as JSON text and nulls
+// as empty strings.
+type Track map[string]string
+
+// decodeTrack converts a raw playlist entry into a Track
+func decodeTrack(raw json.RawMessage) (Track, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+
+	var fields map[string]any
+	if err := dec.Decode(&fields); err != nil {
+		return nil, err
+	}
+
+	track := make(Track, len(fields))
+	for key, value := range fields {
+		switch v := value.(type) {
+		case nil:
+			track[key] = ""
+		case string:
+			track[key] = v
+		case json.Number:
+			track[key] = v.String()
+		case bool:
+			track[key] = fmt.Sprint(v)
+		default:
+			encoded, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			track[key] = string(encoded)
+		}
+	}
+
+	return track, nil
+}
+
+// parsePlaylistTemplate compiles a -playlist-template. Fields the API does not return
+// for a track render as empty text.
+func parsePlaylistTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("playlist").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid playlist template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// formatPlaylist renders each track with tmpl, one track per line
+func formatPlaylist(tracks []Track, tmpl *template.Template) (string, error) {
+	var sb strings.Builder
+	for _, track := range tracks {
+		if err := tmpl.Execute(&sb, track); err != nil {
+			return "", fmt.Errorf("failed to render playlist: %w", err)
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String(), nil
+}
+
+// formatPlaylistJSON renders the tracks as a JSON array, with every field the API returned
+func formatPlaylistJSON(tracks []Track) ([]byte, error) {
+	if tracks == nil {
+		tracks = []Track{} // An empty playlist is [], not null
+	}
+	data, err := json.MarshalIndent(tracks, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to render playlist: %w", err)
+	}
+	return append(data, '\n'), nil
+}
+
+// formatPlaylistCSV renders the tracks as CSV with artist and title columns under a header
+func formatPlaylistCSV(tracks []Track) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"artist", "title"})
+	for _, track := range tracks {
+		w.Write([]string{track["artist"], track["title"]})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, fmt.Errorf("failed to render playlist: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// renderPlaylistFile renders the tracks as the content of a playlist file in format, one
+// of PlaylistFormats. The txt format uses tmpl for each line.
+func renderPlaylistFile(tracks []Track, format string, tmpl *template.Template) ([]byte, error) {
+	switch format {
+	case "json":
+		return formatPlaylistJSON(tracks)
+	case "csv":
+		return formatPlaylistCSV(tracks)
+	default:
+		text, err := formatPlaylist(tracks, tmpl)
+		return []byte(text), err
+	}
+}
+
+// playlistPath returns where the playlist file in format is saved for the MP3 at outputPath
+func playlistPath(outputPath, format string) string {
+	if format == "" {
+		format = "txt"
+	}
+	return strings.TrimSuffix(outputPath, ".mp3") + "." + format
+}
+
+// listPlaylists fetches the playlist of every archive and writes them to w, each under a
+// heading with the episode date, without downloading any audio. Requests are spaced by
+// opts.Delay. It returns an error only if writing to w fails; playlists that cannot be
+// fetched are logged and left out.
+func listPlaylists(ctx context.Context, archives []Archive, opts downloadOptions, w io.Writer) error {
+	logger := slog.Default()
+
+	fetched := 0
+	for _, archive := range archives {
+		if archive.PlaylistID == nil {
+			logger.Info("Archive has no playlist", "date", archive.PlaylistDate)
+			continue
+		}
+
+		if fetched > 0 && sleepContext(ctx, opts.delay()) != nil {
+			break
+		}
+		fetched++
+
+		tracks, _, err := fetchPlaylist(ctx, opts.apiClient(), opts.apiURL(), *archive.PlaylistID)
+		if err != nil {
+			logger.Warn("Failed to fetch playlist",
+				"date", archive.PlaylistDate,
+				"playlist_id", *archive.PlaylistID,
+				"error", err)
+			continue
+		}
+		playlist, err := formatPlaylist(tracks, opts.PlaylistTemplate)
+		if err != nil {
+			return err
+		}
+
+		if _, err := fmt.Fprintf(w, "# %s %s\n%s\n", archive.PlaylistDate, archive.ShowID, playlist); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// backfillPlaylists saves the playlist file of every archive whose MP3 is already in the
+// output directory but whose playlist file is not, without downloading any audio. Requests
+// are spaced by opts.Delay. It returns the number of playlists saved and the number that
+// could not be.
+func backfillPlaylists(ctx context.Context, archives []Archive, opts downloadOptions) (saved, failed int) {
+	logger := slog.Default()
+
+	for _, archive := range archives {
+		if ctx.Err() != nil {
+			break
+		}
+		if archive.PlaylistID == nil {
+			continue
+		}
+		outputPath := filepath.Join(opts.OutputDir, opts.archiveFilename(archive))
+		if _, err := os.Stat(outputPath); err != nil {
+			logger.Debug("Not downloaded, so no playlist to backfill", "path", outputPath)
+			continue
+		}
+		path := playlistPath(outputPath, opts.PlaylistFormat)
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+
+		if saved+failed > 0 && sleepContext(ctx, opts.delay()) != nil {
+			break
+		}
+		tracks, _, err := fetchPlaylist(ctx, opts.apiClient(), opts.apiURL(), *archive.PlaylistID)
+		var content []byte
+		if err == nil {
+			content, err = renderPlaylistFile(tracks, opts.PlaylistFormat, opts.PlaylistTemplate)
+		}
+		if err == nil {
+			err = writeFileAtomic(path, content, 0644)
+		}
+		if err != nil {
+			failed++
+			logger.Warn("Failed to backfill playlist",
+				"date", archive.PlaylistDate,
+				"playlist_id", *archive.PlaylistID,
+				"error", err)
+			continue
+		}
+		saved++
+		logger.Info("Saved playlist", "path", path)
+	}
+
+	return saved, failed
+}
@@ -0,0 +1,348 @@
+// pool.go
+//
+// Parallel downloading. Archives are handed to a pool of workers whose size can be
+// adjusted while the run is in progress. -concurrency fixes the number of workers; with
+// -concurrency-auto a controller grows the pool one worker at a time while aggregate
+// throughput keeps improving and halves it when throughput falls (AIMD).
+
+package wmse
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// autoConcurrencyInterval is how often the auto controller measures throughput
+	autoConcurrencyInterval = 10 * time.Second
+	// autoConcurrencyGain is the improvement needed before another worker is added
+	autoConcurrencyGain = 1.1
+	// autoConcurrencyDrop is the fall in throughput that makes the controller back off
+	autoConcurrencyDrop = 0.75
+)
+
+// Outcome is the result of downloading one archive as part of a run
+type Outcome struct {
+	Result
+	Err    error // Why the archive was not downloaded, if it wasn't
+	Benign bool  // Err is expected and should not count as a failure
+}
+
+// pacer spaces events at least interval apart, however many goroutines are waiting
+type pacer struct {
+	mu       sync.Mutex
+	interval func() time.Duration
+	next     time.Time
+}
+
+// newPacer returns a pacer that releases one caller per interval, asking interval for the
+// spacing each time so it can follow an adaptive delay
+func newPacer(interval func() time.Duration) *pacer {
+	return &pacer{interval: interval}
+}
+
+// wait blocks until the caller's turn, or until ctx ends, in which case it returns ctx's
+// error. The first caller goes straight away.
+func (p *pacer) wait(ctx context.Context) error {
+	p.mu.Lock()
+	now := time.Now()
+	turn := p.next
+	if turn.Before(now) {
+		turn = now
+	}
+	p.next = turn.Add(p.interval())
+	p.mu.Unlock()
+
+	return sleepContext(ctx, time.Until(turn))
+}
+
+// hostLimiter caps the number of distinct hosts being downloaded from at once. Any number
+// of downloads may share a host that is already active.
+type hostLimiter struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	limit  int
+	active map[string]int
+}
+
+// newHostLimiter returns a limiter allowing up to limit hosts at a time
+func newHostLimiter(limit int) *hostLimiter {
+	l := &hostLimiter{limit: limit, active: make(map[string]int)}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// acquire blocks until host may be used and returns a function that releases it
+func (l *hostLimiter) acquire(host string) func() {
+	l.mu.Lock()
+	for l.active[host] == 0 && len(l.active) >= l.limit {
+		l.cond.Wait()
+	}
+	l.active[host]++
+	l.mu.Unlock()
+
+	return func() {
+		l.mu.Lock()
+		l.active[host]--
+		if l.active[host] == 0 {
+			delete(l.active, host)
+			l.cond.Broadcast()
+		}
+		l.mu.Unlock()
+	}
+}
+
+// workerPool runs jobs on a resizable set of goroutines
+type workerPool struct {
+	mu      sync.Mutex
+	running int
+	target  int
+	jobs    chan int
+	wg      sync.WaitGroup
+	work    func(job int)
+}
+
+// resize sets the number of workers. Extra workers are started straight away; surplus
+// workers stop once their current job is finished.
+func (p *workerPool) resize(target int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.target = target
+	for p.running < p.target {
+		p.running++
+		p.wg.Add(1)
+		go p.worker()
+	}
+}
+
+// size returns the number of workers the pool is aiming for
+func (p *workerPool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.target
+}
+
+func (p *workerPool) worker() {
+	defer p.wg.Done()
+	for {
+		p.mu.Lock()
+		if p.running > p.target {
+			p.running--
+			p.mu.Unlock()
+			return
+		}
+		p.mu.Unlock()
+
+		job, ok := <-p.jobs
+		if !ok {
+			p.mu.Lock()
+			p.running--
+			p.mu.Unlock()
+			return
+		}
+		p.work(job)
+	}
+}
+
+// concurrencyOptions controls how many downloads run at once
+type concurrencyOptions struct {
+	Workers    int  // Number of parallel downloads when not adapting automatically
+	Auto       bool // Adapt the number of parallel downloads to measured throughput
+	MaxWorkers int  // Upper limit for Auto
+}
+
+// downloadArchives downloads every archive and returns the outcomes in archive order.
+// Downloads run on conc.Workers workers, or, with conc.Auto, on as many as measured
+// throughput supports up to conc.MaxWorkers. A failed download does not stop the others;
+// once ctx is cancelled, archives not yet started are left with its error.
+func downloadArchives(ctx context.Context, archives []Archive, opts downloadOptions, conc concurrencyOptions) []Outcome {
+	logger := slog.Default()
+	outcomes := make([]Outcome, len(archives))
+	gate := newPauseGate(opts.OutputDir)
+
+	var received, done atomic.Int64
+	opts.BytesReceived = &received
+	if opts.ProgressMode == progressLine {
+		stop := make(chan struct{})
+		defer close(stop)
+		go reportProgressLines(os.Stderr, opts.ProgressInterval, &done, len(archives), &received, stop)
+	}
+
+	download := func(i int) {
+		defer done.Add(1)
+		if err := gate.wait(ctx); err != nil {
+			outcomes[i] = Outcome{Err: err}
+			return
+		}
+		archive := archives[i]
+		if opts.Breaker != nil {
+			if err := opts.Breaker.wait(ctx); err != nil {
+				outcomes[i] = Outcome{Err: err}
+				return
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			outcomes[i] = Outcome{Err: err}
+			return
+		}
+		start := time.Now()
+		result, err := downloadShow(ctx, archive, opts)
+		outcome := Outcome{Result: result, Err: err}
+		switch {
+		case err == nil:
+		case ctx.Err() != nil:
+			logger.Info("Download cancelled",
+				"archive", archive.ShowID,
+				"date", archive.PlaylistDate)
+		case errors.Is(err, ErrDownloadInProgress):
+			outcome.Benign = true
+			logger.Info("Skipping file being downloaded elsewhere",
+				"archive", archive.ShowID,
+				"date", archive.PlaylistDate,
+				"reason", err)
+		case errors.Is(err, ErrNoArchiveURL) && opts.SkipMissingURL:
+			outcome.Benign = true
+			logger.Info("Skipping archive that has no MP3 URL yet",
+				"archive", archive.ShowID,
+				"date", archive.PlaylistDate)
+		default:
+			logger.Error("Download failed",
+				"archive", archive.ShowID,
+				"date", archive.PlaylistDate,
+				"error", err,
+				requestIDAttr(result.RequestID))
+		}
+		// Skips say nothing about the server, and cancellations are not its fault
+		if opts.Breaker != nil && ctx.Err() == nil && !outcome.Benign && !result.Skipped {
+			opts.Breaker.record(err)
+		}
+		if opts.Metrics != nil && ctx.Err() == nil {
+			opts.Metrics.record(outcome, time.Since(start))
+		}
+		outcomes[i] = outcome
+	}
+
+	if !conc.Auto && conc.Workers <= 1 {
+		for i := range archives {
+			download(i)
+		}
+		return outcomes
+	}
+
+	// Progress bars from several workers would overwrite each other
+	opts.HideProgress = true
+
+	var pending sync.WaitGroup
+	pending.Add(len(archives))
+	pool := &workerPool{
+		jobs: make(chan int, len(archives)),
+		work: func(i int) {
+			defer pending.Done()
+			download(i)
+		},
+	}
+	for i := range archives {
+		pool.jobs <- i
+	}
+	close(pool.jobs)
+
+	if !conc.Auto {
+		pool.resize(conc.Workers)
+		pending.Wait()
+		pool.wg.Wait()
+		return outcomes
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		controlConcurrency(pool, &received, conc.MaxWorkers, stop)
+	}()
+
+	pool.resize(1)
+	pending.Wait()
+	close(stop)
+	<-stopped
+	pool.wg.Wait()
+
+	return outcomes
+}
+
+// retryDeferred makes a second pass, after cooldown, over the archives that failed in the
+// first one and updates their outcomes. Used with -defer-retries, where the first pass makes
+// a single attempt per archive so one persistently failing file cannot hold up the rest.
+// Failures that would only happen again, such as an HTML page in place of the MP3, are left.
+func retryDeferred(ctx context.Context, archives []Archive, outcomes []Outcome, opts downloadOptions, conc concurrencyOptions, cooldown time.Duration) {
+	var failed []int
+	for i, outcome := range outcomes {
+		if outcome.Err != nil && !outcome.Benign && retryable(outcome.Err) {
+			failed = append(failed, i)
+		}
+	}
+	if len(failed) == 0 {
+		return
+	}
+
+	slog.Default().Info("Retrying failed downloads",
+		"count", len(failed),
+		"cooldown", cooldown)
+	if sleepContext(ctx, cooldown) != nil {
+		return
+	}
+
+	retry := make([]Archive, len(failed))
+	for j, i := range failed {
+		retry[j] = archives[i]
+	}
+	for j, outcome := range downloadArchives(ctx, retry, opts, conc) {
+		outcomes[failed[j]] = outcome
+	}
+}
+
+// controlConcurrency adjusts the pool size from the byte counter until stop is closed.
+// Workers are added one at a time while throughput keeps improving and halved when it drops.
+func controlConcurrency(pool *workerPool, received *atomic.Int64, maxWorkers int, stop <-chan struct{}) {
+	logger := slog.Default()
+	ticker := time.NewTicker(autoConcurrencyInterval)
+	defer ticker.Stop()
+
+	var last int64
+	var best float64
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		total := received.Load()
+		rate := float64(total-last) / autoConcurrencyInterval.Seconds()
+		last = total
+
+		workers := pool.size()
+		switch {
+		case rate > best*autoConcurrencyGain:
+			best = rate
+			if workers < maxWorkers {
+				workers++
+			}
+		case rate < best*autoConcurrencyDrop:
+			workers = max(1, workers/2)
+			best = rate
+		}
+
+		if workers != pool.size() {
+			logger.Info("Adjusting concurrency",
+				"workers", workers,
+				"bytes_per_second", int64(rate))
+			pool.resize(workers)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// progress.go
+//
+// Progress reporting modes for -progress-mode. "bar" draws a single-line progress bar that
+// is redrawn in place on a terminal, "log" logs each download's progress at
+// -progress-interval, "line" prints one plain timestamped summary line per interval for CI
+// logs, and "none" stays quiet.
+
+package wmse
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// Progress modes accepted by -progress-mode
+const (
+	progressBar  = "bar"
+	progressLog  = "log"
+	progressLine = "line"
+	progressNone = "none"
+)
+
+// defaultProgressInterval is how often the log and line modes report
+const defaultProgressInterval = 30 * time.Second
+
+// ProgressModes lists the values accepted for Options.ProgressMode
+var ProgressModes = []string{progressBar, progressLog, progressLine, progressNone}
+
+const (
+	// speedWindow is how far back the progress bar looks when working out the speed
+	speedWindow = 5 * time.Second
+	// barRedrawInterval is the shortest time between progress bar redraws
+	barRedrawInterval = 100 * time.Millisecond
+	// defaultBarWidth is the line length used when the terminal width is unknown
+	defaultBarWidth = 80
+	// barCells is the width of the bar between its brackets
+	barCells = 20
+)
+
+// isTerminal reports whether f is an interactive terminal rather than a file or pipe
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// rateSample is the byte count at one moment
+type rateSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// rollingRate measures throughput over the last speedWindow, so the speed shown follows
+// the current transfer rather than the average since the download began
+type rollingRate struct {
+	samples []rateSample
+}
+
+// add records that total bytes had arrived at now
+func (r *rollingRate) add(now time.Time, total int64) {
+	r.samples = append(r.samples, rateSample{at: now, bytes: total})
+	i := 0
+	for i < len(r.samples)-2 && now.Sub(r.samples[i+1].at) >= speedWindow {
+		i++
+	}
+	r.samples = r.samples[i:]
+}
+
+// rate returns the bytes per second across the window, or 0 before there is enough data
+func (r *rollingRate) rate() float64 {
+	if len(r.samples) < 2 {
+		return 0
+	}
+	first, last := r.samples[0], r.samples[len(r.samples)-1]
+	elapsed := last.at.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(last.bytes-first.bytes) / elapsed
+}
+
+// terminalBar is a single-line progress bar showing percentage, bytes, speed and time
+// remaining, redrawn in place with a carriage return
+type terminalBar struct {
+	w        io.Writer
+	name     string
+	width    int
+	total    int64 // Expected size, or -1 if unknown
+	done     int64
+	speed    rollingRate
+	lastDraw time.Time
+	drawn    int // Length of the last line drawn, so a shorter one can blank it out
+}
+
+// newTerminalBar returns a bar for a download of total bytes (-1 if unknown) of which
+// done have already arrived
+func newTerminalBar(f *os.File, name string, done, total int64) *terminalBar {
+	width := defaultBarWidth
+	if w, _, err := term.GetSize(int(f.Fd())); err == nil && w > 0 {
+		width = w - 1
+	}
+	b := &terminalBar{w: f, name: name, width: width, total: total, done: done}
+	b.speed.add(time.Now(), done)
+	return b
+}
+
+// add advances the bar by n bytes, redrawing it at most every barRedrawInterval
+func (b *terminalBar) add(n int64) {
+	b.done += n
+	now := time.Now()
+	b.speed.add(now, b.done)
+	if now.Sub(b.lastDraw) >= barRedrawInterval {
+		b.lastDraw = now
+		b.draw()
+	}
+}
+
+// finish draws the final state and moves to a new line
+func (b *terminalBar) finish() {
+	b.draw()
+	fmt.Fprintln(b.w)
+}
+
+// draw writes the current line over the previous one
+func (b *terminalBar) draw() {
+	rate := b.speed.rate()
+	stats := fmt.Sprintf(" %s %s/s", formatBytes(b.done), formatBytes(int64(rate)))
+	if b.total > 0 {
+		percent := min(float64(b.done)/float64(b.total), 1)
+		eta := "--:--"
+		if rate > 0 {
+			eta = formatETA(time.Duration(float64(b.total-b.done) / rate * float64(time.Second)))
+		}
+		stats = fmt.Sprintf(" %5.1f%% %s/%s %s/s ETA %s",
+			percent*100, formatBytes(b.done), formatBytes(b.total), formatBytes(int64(rate)), eta)
+
+		// The bar itself is left out when the terminal is too narrow for it
+		if len(b.name)+len(stats)+barCells+3 <= b.width {
+			filled := int(percent * barCells)
+			stats = " [" + strings.Repeat("=", filled) + strings.Repeat(" ", barCells-filled) + "]" + stats
+		}
+	}
+
+	line := b.name + stats
+	if len(line) > b.width {
+		line = line[len(line)-b.width:]
+	}
+	padding := max(b.drawn-len(line), 0)
+	fmt.Fprintf(b.w, "\r%s%s", line, strings.Repeat(" ", padding))
+	b.drawn = len(line)
+}
+
+// formatETA formats a remaining time as m:ss, or h:mm:ss from an hour up
+func formatETA(d time.Duration) string {
+	d = d.Round(time.Second)
+	h, m, s := int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%d:%02d", m, s)
+}
+
+// reportProgressLines writes a summary line to w every interval until stop is closed
+func reportProgressLines(w io.Writer, interval time.Duration, done *atomic.Int64, total int, received *atomic.Int64, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	start := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			bytes := received.Load()
+			rate := float64(bytes) / now.Sub(start).Seconds()
+			fmt.Fprintf(w, "%s progress: %d/%d files, %s received, %s/s\n",
+				now.Format(time.RFC3339), done.Load(), total, formatBytes(bytes), formatBytes(int64(rate)))
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// prune.go
+//
+// Support for -keep-last and -prune, which cap the number of episodes kept on disk for
+// each show so a rolling local archive stays a bounded size.
+
+package wmse
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// pruneCandidate is an episode file on disk that pruning may remove
+type pruneCandidate struct {
+	path string
+	date time.Time
+}
+
+// pruneArchives keeps the newest keep episodes of each show in opts.OutputDir and removes the
+// rest, newest being decided by playlist date rather than modification time. Files listed in
+// protected (downloaded during this run) are never removed. Unless apply is set, the files that
+// would be removed are only logged.
+func pruneArchives(archives []Archive, opts downloadOptions, keep int, protected map[string]bool, apply bool) error {
+	logger := slog.Default()
+
+	// Episodes known from the API, keyed by path relative to the output directory, and the
+	// filename suffix of each show
+	type knownEpisode struct {
+		showID string
+		date   time.Time
+	}
+	known := make(map[string]knownEpisode)
+	suffixes := make(map[string]string)
+	for _, archive := range archives {
+		if date, err := archiveDateIn(archive, opts.Location); err == nil {
+			known[opts.archiveFilename(archive)] = knownEpisode{archive.ShowID, date}
+		}
+		suffixes[archive.ShowID] = "_" + sanitizeFilename(archive.ShowID, 0)
+	}
+
+	byShow := make(map[string][]pruneCandidate)
+	// A -template may put episodes in subdirectories
+	err := filepath.WalkDir(opts.OutputDir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Episodes linked into a -global-store may be symlinks
+		if !entry.Type().IsRegular() && entry.Type()&os.ModeSymlink == 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(opts.OutputDir, path)
+		if err != nil {
+			return err
+		}
+
+		if episode, ok := known[rel]; ok {
+			byShow[episode.showID] = append(byShow[episode.showID], pruneCandidate{path: path, date: episode.date})
+			return nil
+		}
+
+		// Episodes no longer listed by the API still carry their date in a default filename
+		name := entry.Name()
+		for showID, suffix := range suffixes {
+			if !strings.HasSuffix(name, suffix) {
+				continue
+			}
+			date, err := parsePlaylistDate(strings.TrimSuffix(name, suffix), opts.Location)
+			if err != nil {
+				logger.Debug("Not pruning file with unrecognised date", "filename", rel)
+				break
+			}
+			byShow[showID] = append(byShow[showID], pruneCandidate{path: path, date: date})
+			break
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not read output directory: %w", err)
+	}
+
+	showIDs := make([]string, 0, len(byShow))
+	for showID := range byShow {
+		showIDs = append(showIDs, showID)
+	}
+	sort.Strings(showIDs)
+
+	for _, showID := range showIDs {
+		files := byShow[showID]
+		if len(files) <= keep {
+			continue
+		}
+
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].date.After(files[j].date)
+		})
+
+		var pruned []string
+		for _, file := range files[keep:] {
+			date := file.date.Format("2006-01-02")
+			if protected[file.path] {
+				logger.Warn("Keeping episode downloaded during this run",
+					"path", file.path,
+					"date", date)
+				continue
+			}
+
+			if !apply {
+				logger.Info("Would prune episode (pass -prune to delete)",
+					"path", file.path,
+					"date", date)
+				continue
+			}
+
+			if err := os.Remove(file.path); err != nil {
+				logger.Error("Failed to prune episode",
+					"path", file.path,
+					"error", err)
+				continue
+			}
+			logger.Info("Pruned episode",
+				"path", file.path,
+				"date", date)
+			pruned = append(pruned, file.path)
+
+			for _, format := range PlaylistFormats {
+				playlistPath := playlistPath(file.path, format)
+				if err := os.Remove(playlistPath); err == nil {
+					logger.Info("Pruned playlist", "path", playlistPath)
+				}
+			}
+			nfoPath := strings.TrimSuffix(file.path, ".mp3") + ".nfo"
+			if err := os.Remove(nfoPath); err == nil {
+				logger.Info("Pruned episode description", "path", nfoPath)
+			}
+			if err := os.Remove(metaSidecarPath(file.path)); err == nil {
+				logger.Info("Pruned download metadata", "path", metaSidecarPath(file.path))
+			}
+		}
+
+		if len(pruned) > 0 && opts.Checksums != nil {
+			if err := opts.Checksums.forget(pruned); err != nil {
+				logger.Warn("Failed to remove pruned episodes from checksum manifest", "error", err)
+			}
+		}
+	}
+
+	return nil
+}
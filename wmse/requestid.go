@@ -0,0 +1,53 @@
+// requestid.go
+//
+// Request IDs added by a transport, such as the one behind -request-id-header, reach the
+// downloader through each request's context, so its own log records of retries, failures
+// and completed downloads name the request they came from.
+
+package wmse
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// requestIDKey is the context key of a requestIDSlot
+type requestIDKey struct{}
+
+// requestIDSlot holds the ID of the latest request sent with a context
+type requestIDSlot struct {
+	mu sync.Mutex
+	id string
+}
+
+// withRequestIDSlot returns ctx with an empty slot for the ID of the request sent with it
+func withRequestIDSlot(ctx context.Context) (context.Context, *requestIDSlot) {
+	slot := &requestIDSlot{}
+	return context.WithValue(ctx, requestIDKey{}, slot), slot
+}
+
+// SetRequestID records id as the ID of a request sent with ctx, for the downloader's log
+// records. It does nothing if ctx was not made by the downloader.
+func SetRequestID(ctx context.Context, id string) {
+	if slot, ok := ctx.Value(requestIDKey{}).(*requestIDSlot); ok {
+		slot.mu.Lock()
+		slot.id = id
+		slot.mu.Unlock()
+	}
+}
+
+// get returns the ID recorded in the slot, or "" if none was
+func (s *requestIDSlot) get() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.id
+}
+
+// requestIDAttr is the request_id log attribute for id, or nothing if id is empty
+func requestIDAttr(id string) slog.Attr {
+	if id == "" {
+		return slog.Attr{}
+	}
+	return slog.String("request_id", id)
+}
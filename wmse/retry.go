@@ -0,0 +1,256 @@
+// retry.go
+//
+// Error classification for download retries. Each kind of failure (server errors,
+// network errors, timeouts, everything else) has its own retry budget so that, for
+// example, a flaky DNS resolver can be given more patience than a 5xx storm.
+
+package wmse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultRetries is the number of retries allowed for each kind of error unless configured
+	defaultRetries = 2
+	// defaultBackoffBase is the delay before the first retry unless configured. Before the
+	// strategies existed retries waited 2s more each time, starting at 4s; doubling from 2s
+	// is sooner at first and backs off further after that.
+	defaultBackoffBase = 2 * time.Second
+	// defaultBackoffCap is the longest delay between retries unless configured
+	defaultBackoffCap = time.Minute
+)
+
+// HTTPError is returned when a server answers with a status other than the one expected
+type HTTPError struct {
+	URL        string        // Requested URL
+	StatusCode int           // Numeric status code
+	Status     string        // Status line, e.g. "503 Service Unavailable"
+	RetryAfter time.Duration // How long the server asked us to wait, from Retry-After
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("bad status downloading %s: %s", e.URL, e.Status)
+}
+
+// parseRetryAfter reads a Retry-After header, given either as a number of seconds or as an
+// HTTP date, and returns how long to wait from now. It returns 0 if the header is absent,
+// malformed or already in the past.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil && when.After(now) {
+		return when.Sub(now)
+	}
+	return 0
+}
+
+// retryDelay is how long to wait before the given attempt: the backoff delay, or longer if
+// the server said when to come back
+func retryDelay(backoff Backoff, attempt int, lastErr error) time.Duration {
+	delay := backoff.Next(attempt)
+	var httpErr *HTTPError
+	if errors.As(lastErr, &httpErr) && httpErr.RetryAfter > delay {
+		delay = httpErr.RetryAfter
+	}
+	return delay
+}
+
+// errorClass groups errors that share a retry budget
+type errorClass string
+
+const (
+	errorClassServer  errorClass = "5xx"
+	errorClassClient  errorClass = "4xx"
+	errorClassNetwork errorClass = "network"
+	errorClassTimeout errorClass = "timeout"
+	errorClassOther   errorClass = "other"
+	// errorClassPermanent is for responses that will be the same however often they are
+	// asked for, such as an HTML error page in place of the MP3
+	errorClassPermanent errorClass = "permanent"
+)
+
+// classifyError works out which retry budget an error draws from
+func classifyError(err error) errorClass {
+	if errors.Is(err, ErrInvalidContentType) || errors.Is(err, ErrMarkupChanged) || errors.Is(err, ErrFileTooLarge) {
+		return errorClassPermanent
+	}
+
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		if httpErr.StatusCode >= 500 {
+			return errorClassServer
+		}
+		return errorClassClient
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return errorClassTimeout
+	}
+	if netErr != nil || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errorClassNetwork
+	}
+	return errorClassOther
+}
+
+// retryable reports whether a failed download is worth trying again. An oversized file
+// will be just as big next time, a page served in place of the MP3 will be served again,
+// and a 4xx response means the request itself is wrong (a 404 will not go away), except
+// for 408 and 429, which ask the client to come back later.
+func retryable(err error) bool {
+	if classifyError(err) == errorClassPermanent {
+		return false
+	}
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) && httpErr.StatusCode >= 400 && httpErr.StatusCode < 500 {
+		return httpErr.StatusCode == http.StatusRequestTimeout || httpErr.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// UniformRetryPolicy allows n retries for every kind of error
+func UniformRetryPolicy(n int) RetryPolicy {
+	return RetryPolicy{ServerError: n, Network: n, Timeout: n, Other: n}
+}
+
+// RetryPolicy is the number of retries allowed for each class of error
+type RetryPolicy struct {
+	ServerError int // After a 5xx response
+	Network     int // After a connection or DNS failure
+	Timeout     int // After a request timed out
+	Other       int // After anything else, such as a 408 or 429 response; other 4xx are not retried
+}
+
+// defaultRetryPolicy allows the same number of retries for every kind of error
+func defaultRetryPolicy() RetryPolicy {
+	return UniformRetryPolicy(defaultRetries)
+}
+
+// limit returns the number of retries allowed for class
+func (p RetryPolicy) limit(class errorClass) int {
+	switch class {
+	case errorClassServer:
+		return p.ServerError
+	case errorClassNetwork:
+		return p.Network
+	case errorClassTimeout:
+		return p.Timeout
+	case errorClassPermanent:
+		return 0
+	default:
+		return p.Other
+	}
+}
+
+// Backoff decides how long to wait before retrying
+type Backoff interface {
+	// Next returns the delay before the given attempt, where attempt 2 is the first retry
+	Next(attempt int) time.Duration
+}
+
+// BackoffNames lists the strategies accepted for Options.Backoff
+var BackoffNames = []string{"exponential", "linear", "constant", "fibonacci"}
+
+// exponentialBackoff doubles the delay on every retry: base, 2*base, 4*base, ...
+type exponentialBackoff struct{ base, cap time.Duration }
+
+func (b exponentialBackoff) Next(attempt int) time.Duration {
+	d := b.base
+	for i := 2; i < attempt && (b.cap <= 0 || d < b.cap); i++ {
+		d *= 2
+	}
+	return capDelay(d, b.cap)
+}
+
+// linearBackoff grows the delay by base on every retry: base, 2*base, 3*base, ...
+type linearBackoff struct{ base, cap time.Duration }
+
+func (b linearBackoff) Next(attempt int) time.Duration {
+	return capDelay(b.base*time.Duration(max(attempt-1, 1)), b.cap)
+}
+
+// constantBackoff always waits base
+type constantBackoff struct{ base, cap time.Duration }
+
+func (b constantBackoff) Next(int) time.Duration {
+	return capDelay(b.base, b.cap)
+}
+
+// fibonacciBackoff follows the Fibonacci sequence: base, base, 2*base, 3*base, 5*base, ...
+type fibonacciBackoff struct{ base, cap time.Duration }
+
+func (b fibonacciBackoff) Next(attempt int) time.Duration {
+	prev, cur := time.Duration(0), b.base
+	for i := 2; i < attempt && (b.cap <= 0 || cur < b.cap); i++ {
+		prev, cur = cur, prev+cur
+	}
+	return capDelay(cur, b.cap)
+}
+
+// fullJitter spreads retries out by waiting a random time between zero and the delay the
+// wrapped strategy asks for, so downloads that failed together don't retry together
+type fullJitter struct{ Backoff }
+
+func (b fullJitter) Next(attempt int) time.Duration {
+	d := b.Backoff.Next(attempt)
+	if d <= 0 {
+		return 0
+	}
+	return rand.N(d + 1)
+}
+
+// capDelay limits d to limit, where a limit of zero means no limit
+func capDelay(d, limit time.Duration) time.Duration {
+	if limit > 0 && d > limit {
+		return limit
+	}
+	return d
+}
+
+// newBackoff builds the named strategy with the given base delay and cap (0 for no cap)
+func newBackoff(name string, base, limit time.Duration) (Backoff, error) {
+	if base <= 0 {
+		return nil, fmt.Errorf("backoff base must be positive, got %s", base)
+	}
+
+	switch name {
+	case "exponential":
+		return exponentialBackoff{base: base, cap: limit}, nil
+	case "linear":
+		return linearBackoff{base: base, cap: limit}, nil
+	case "constant":
+		return constantBackoff{base: base, cap: limit}, nil
+	case "fibonacci":
+		return fibonacciBackoff{base: base, cap: limit}, nil
+	default:
+		return nil, fmt.Errorf("unknown backoff %q (want one of %s)", name, strings.Join(BackoffNames, ", "))
+	}
+}
+
+// sleepContext waits for d, returning early with the context's error if ctx is cancelled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,80 @@
+// serve.go
+//
+// Support for -serve, which exposes the output directory over HTTP while the run is in
+// progress so episodes can be played straight away. An episode that is still downloading
+// is served from its temporary file, with range support, as far as it has got.
+
+package wmse
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// archiveServer serves the files in an output directory
+type archiveServer struct {
+	dir   string
+	files http.Handler
+}
+
+// newArchiveServer returns a handler for the files in dir
+func newArchiveServer(dir string) *archiveServer {
+	return &archiveServer{dir: dir, files: http.FileServer(http.Dir(dir))}
+}
+
+// ServeHTTP serves the named file, falling back to its in-progress download for MP3s
+func (s *archiveServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The directory listing, and anything not named directly, goes to the file server
+	name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+	if name == "" || strings.Contains(name, "/") {
+		s.files.ServeHTTP(w, r)
+		return
+	}
+
+	f, err := os.Open(filepath.Join(s.dir, name))
+	partial := false
+	if errors.Is(err, os.ErrNotExist) && strings.HasSuffix(name, ".mp3") {
+		f, err = os.Open(filepath.Join(s.dir, name+tempSuffix))
+		partial = true
+	}
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+
+	if partial {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("X-Download-In-Progress", "true")
+	}
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+// startArchiveServer serves dir on addr in the background
+func startArchiveServer(addr, dir string) {
+	logger := slog.Default()
+	server := &http.Server{Addr: addr, Handler: newArchiveServer(dir)}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil {
+			logger.Error("Archive server stopped", "addr", addr, "error", err)
+		}
+	}()
+	logger.Info("Serving output directory", "addr", addr, "dir", dir)
+}
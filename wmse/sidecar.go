@@ -0,0 +1,50 @@
+// sidecar.go
+//
+// Support for -meta-sidecar, which writes a <name>.meta.json file next to each download
+// recording where it came from and how the transfer went, for archival and debugging.
+
+package wmse
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// downloadMeta is the provenance record written beside a downloaded MP3
+type downloadMeta struct {
+	SourceURL     string    `json:"source_url"`               // Archive URL from the API
+	FinalURL      string    `json:"final_url"`                // URL the file was served from after redirects
+	StatusCode    int       `json:"status_code"`              // HTTP status of the successful response
+	ContentType   string    `json:"content_type"`             // Content-Type of the successful response
+	ContentLength int64     `json:"content_length"`           // Declared length, -1 if the server sent none
+	Started       time.Time `json:"started"`                  // When the first attempt began
+	Finished      time.Time `json:"finished"`                 // When the transfer completed
+	BytesWritten  int64     `json:"bytes_written"`            // Size of the saved file
+	SHA256        string    `json:"sha256"`                   // Checksum of the saved file
+	Retries       int       `json:"retries"`                  // Attempts made before the one that succeeded
+	PlaylistID    *string   `json:"playlist_id"`              // Playlist the episode is linked to, if any
+	Playlist      []Track   `json:"playlist,omitempty"`       // Tracks of the playlist, if it was fetched
+	PlaylistError string    `json:"playlist_error,omitempty"` // Why the playlist could not be fetched
+}
+
+// metaSidecarSuffix replaces .mp3 in the name of an MP3's provenance record
+const metaSidecarSuffix = ".meta.json"
+
+// metaSidecarPath returns the path of the provenance record for an MP3
+func metaSidecarPath(outputPath string) string {
+	return strings.TrimSuffix(outputPath, ".mp3") + metaSidecarSuffix
+}
+
+// writeMetaSidecar saves meta next to the MP3 at outputPath
+func writeMetaSidecar(outputPath string, meta *downloadMeta) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode download metadata: %w", err)
+	}
+	if err := writeFileAtomic(metaSidecarPath(outputPath), data, 0644); err != nil {
+		return fmt.Errorf("failed to save download metadata: %w", err)
+	}
+	return nil
+}
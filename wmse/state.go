@@ -0,0 +1,94 @@
+// state.go
+//
+// The download state file. Each completed download is recorded in .wmse-state.json in the
+// output directory, keyed by show and playlist date, so later runs know what has already
+// been fetched even if the filename template changes or files are moved. -force ignores it.
+
+package wmse
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// stateFile is the name of the state file in the output directory
+const stateFile = ".wmse-state.json"
+
+// stateEntry records one completed download
+type stateEntry struct {
+	Path       string    `json:"path"`                  // Where the file was saved, relative to the output directory
+	Size       int64     `json:"size"`                  // Size of the file when it was recorded
+	SHA256     string    `json:"sha256,omitempty"`      // Content hash, when the file was downloaded rather than found
+	Completed  time.Time `json:"completed"`             // When the download was recorded
+	URL        string    `json:"url,omitempty"`         // Archive URL the file came from
+	RemoteSize int64     `json:"remote_size,omitempty"` // Size the server sent, when the file was downloaded
+}
+
+// downloadState is the set of completed downloads in an output directory
+type downloadState struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]stateEntry
+}
+
+// stateKey identifies an archive in the state file
+func stateKey(archive Archive) string {
+	return archive.ShowID + "/" + archive.PlaylistDate
+}
+
+// loadDownloadState reads the state file in dir. A missing file is an empty state.
+func loadDownloadState(dir string) (*downloadState, error) {
+	s := &downloadState{
+		path:    filepath.Join(dir, stateFile),
+		entries: make(map[string]stateEntry),
+	}
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read download state: %w", err)
+	}
+	if err := json.Unmarshal(data, &s.entries); err != nil {
+		return nil, fmt.Errorf("could not parse download state %s: %w", s.path, err)
+	}
+	return s, nil
+}
+
+// lookup returns the recorded download of archive, if there is one
+func (s *downloadState) lookup(archive Archive) (stateEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[stateKey(archive)]
+	return entry, ok
+}
+
+// record marks archive as downloaded to path, relative to the output directory, and saves
+// the state file. remoteSize is the size the server sent, or 0 if the file was not downloaded.
+func (s *downloadState) record(archive Archive, path string, size int64, sum string, remoteSize int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[stateKey(archive)] = stateEntry{
+		Path:       filepath.ToSlash(path),
+		Size:       size,
+		SHA256:     sum,
+		Completed:  time.Now().UTC(),
+		URL:        archive.ArchiveURL,
+		RemoteSize: remoteSize,
+	}
+
+	data, err := json.MarshalIndent(s.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0644)
+}
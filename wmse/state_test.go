@@ -0,0 +1,73 @@
+package wmse
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStateSurvivesCrashBeforeRename(t *testing.T) {
+	dir := t.TempDir()
+	state, err := loadDownloadState(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := Archive{ShowID: "ded", PlaylistDate: "2024-01-01", ArchiveURL: "https://example.com/a.mp3"}
+	if err := state.record(first, "2024-01-01_ded.mp3", 100, "", 100); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(state.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The process dies once the new state is written but before it is renamed into place
+	renameFile = func(string, string) error { panic("crash") }
+	t.Cleanup(func() { renameFile = os.Rename })
+	second := Archive{ShowID: "ded", PlaylistDate: "2024-01-08", ArchiveURL: "https://example.com/b.mp3"}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("record did not reach the rename")
+			}
+		}()
+		state.record(second, "2024-01-08_ded.mp3", 100, "", 100)
+	}()
+
+	after, err := os.ReadFile(state.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Errorf("state file changed by the interrupted write:\n%s", after)
+	}
+	reloaded, err := loadDownloadState(dir)
+	if err != nil {
+		t.Fatalf("state file unreadable after the crash: %v", err)
+	}
+	if _, ok := reloaded.lookup(first); !ok {
+		t.Error("earlier download lost from the state file")
+	}
+	if _, ok := reloaded.lookup(second); ok {
+		t.Error("download from the interrupted write is in the state file")
+	}
+
+	// The crash leaves the new state in a temporary file beside it, not in the state file
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var temps []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), tempSuffix) {
+			temps = append(temps, filepath.Join(dir, entry.Name()))
+		}
+	}
+	if len(temps) != 1 {
+		t.Fatalf("temporary files after the crash = %v, want one", temps)
+	}
+	if data, _ := os.ReadFile(temps[0]); !strings.Contains(string(data), "2024-01-08") {
+		t.Errorf("temporary file does not hold the new state:\n%s", data)
+	}
+}
@@ -0,0 +1,156 @@
+// store.go
+//
+// Support for -global-store, a content-addressed directory shared by every show. Each
+// distinct MP3 is kept once in the store, named by its SHA-256, and episode files are
+// links to it, so reruns and repeated segments across shows take no extra space.
+
+package wmse
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// runURLs remembers where each archive URL was saved during this run
+type runURLs struct {
+	mu    sync.Mutex
+	files map[string]savedFile
+}
+
+// savedFile is where an archive was saved and the SHA-256 of the finished file
+type savedFile struct {
+	path string
+	sum  string
+}
+
+// lookup returns the file archiveURL was saved to earlier in the run, if any
+func (r *runURLs) lookup(archiveURL string) (savedFile, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	file, ok := r.files[archiveURL]
+	return file, ok
+}
+
+// record notes that archiveURL has been saved to path, whose content hashes to sum
+func (r *runURLs) record(archiveURL, path, sum string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.files == nil {
+		r.files = make(map[string]savedFile)
+	}
+	r.files[archiveURL] = savedFile{path: path, sum: sum}
+}
+
+// linkOrCopy makes dst a hard link to src, copying the file where links are not possible
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(src, dst)
+}
+
+// storePath returns where content with the given hex SHA-256 lives in store
+func storePath(store, sum string) string {
+	return filepath.Join(store, sum[:2], sum+".mp3")
+}
+
+// storeContent adds the file at path, whose hex SHA-256 is sum, to store and replaces
+// path with a link to the stored copy. Content already in the store is not written again.
+func storeContent(store, path, sum string) error {
+	logger := slog.Default()
+	target := storePath(store, sum)
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("could not create store directory: %w", err)
+	}
+
+	if _, err := os.Stat(target); err == nil {
+		if err := linkToStore(target, path); err != nil {
+			return err
+		}
+		logger.Info("Linked duplicate content from global store",
+			"path", path,
+			"sha256", sum)
+		return nil
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("could not check global store: %w", err)
+	}
+
+	// A hard link shares the data without copying; across filesystems fall back to a copy
+	if err := os.Link(path, target); err == nil {
+		logger.Debug("Added file to global store", "path", path, "sha256", sum)
+		return nil
+	}
+	if err := copyFile(path, target); err != nil {
+		return fmt.Errorf("could not add %s to global store: %w", path, err)
+	}
+	if err := linkToStore(target, path); err != nil {
+		return err
+	}
+	logger.Debug("Copied file to global store", "path", path, "sha256", sum)
+
+	return nil
+}
+
+// linkToStore replaces path with a hard link to target, or a symlink when the two are on
+// different filesystems. The swap is made with a rename so path is never missing.
+func linkToStore(target, path string) error {
+	tmp := path + ".link" + tempSuffix
+	os.Remove(tmp)
+
+	if err := os.Link(target, tmp); err != nil {
+		abs, err := filepath.Abs(target)
+		if err != nil {
+			return fmt.Errorf("could not resolve store path: %w", err)
+		}
+		if err := os.Symlink(abs, tmp); err != nil {
+			return fmt.Errorf("could not link %s to global store: %w", path, err)
+		}
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("could not replace %s with store link: %w", path, err)
+	}
+
+	return nil
+}
+
+// copyFile copies src to dst via a temporary file in dst's directory
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+atomicTempPattern)
+	if err != nil {
+		return err
+	}
+	tmpPath := out.Name()
+
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, dst)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
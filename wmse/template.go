@@ -0,0 +1,67 @@
+// template.go
+//
+// Support for Options.FilenameTemplate (-template), which names downloaded files with a Go text/template so that,
+// for example, each show can be given its own subdirectory. Whatever the template
+// produces is sanitized one path component at a time, so it can never leave -out.
+
+package wmse
+
+import (
+	"cmp"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// defaultFilenameTemplate reproduces the original <date>_<show>.mp3 naming
+const defaultFilenameTemplate = "{{.PlaylistDate}}_{{.ShowID}}.mp3"
+
+// parseFilenameTemplate parses a filename template. Fields the archive does not have render
+// empty rather than failing.
+func parseFilenameTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("filename").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filename template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// fieldSeparators stops a slash inside a field value from starting a new directory
+var fieldSeparators = strings.NewReplacer("/", "_", "\\", "_")
+
+// templateFields returns the values a filename template can refer to
+func templateFields(archive Archive) map[string]string {
+	return map[string]string{
+		"ShowID":       fieldSeparators.Replace(archive.ShowID),
+		"PlaylistDate": fieldSeparators.Replace(archive.PlaylistDate),
+		"Name":         fieldSeparators.Replace(archive.Name),
+		"Show":         fieldSeparators.Replace(cmp.Or(archive.Name, archive.ShowID)),
+		"Title":        fieldSeparators.Replace(archive.Title),
+	}
+}
+
+// renderFilename expands tmpl for archive and returns a path relative to the output
+// directory. Each component is sanitized separately; directories left empty, such as "."
+// and "..", are dropped. The last component is the file name and is shortened to maxLength.
+func renderFilename(tmpl *template.Template, archive Archive, maxLength int) (string, error) {
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, templateFields(archive)); err != nil {
+		return "", fmt.Errorf("could not expand filename template: %w", err)
+	}
+
+	components := strings.FieldsFunc(sb.String(), func(r rune) bool { return r == '/' || r == '\\' })
+	if len(components) == 0 {
+		return "", fmt.Errorf("filename template produced an empty name for %s", archive.ShowID)
+	}
+
+	var parts []string
+	for _, part := range components[:len(components)-1] {
+		if part = cleanPathComponent(strings.TrimSpace(part)); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	// The file name is cleaned as a whole so its extension is kept
+	parts = append(parts, sanitizeFilename(strings.TrimSpace(components[len(components)-1]), maxLength))
+	return filepath.Join(parts...), nil
+}
@@ -0,0 +1,93 @@
+// templock.go
+//
+// Per-file locks for in-progress downloads. While a .tmp file is being written, a
+// .tmp.lock file next to it records the owning process so that other instances working
+// in the same directory leave it alone. Locks taken by this process are also kept in memory,
+// so two workers of one run never write the same file.
+
+package wmse
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// tempLockSuffix is appended to a temp file's name to form its lock file
+const tempLockSuffix = ".lock"
+
+// ErrDownloadInProgress is returned when another live process, or another worker of this
+// one, is already writing a file
+var ErrDownloadInProgress = errors.New("download in progress elsewhere")
+
+// heldLocks is the lock files held by this process
+var heldLocks = struct {
+	sync.Mutex
+	paths map[string]bool
+}{paths: make(map[string]bool)}
+
+// tempLock is the content of a lock file
+type tempLock struct {
+	PID     int       `json:"pid"`     // Process writing the temp file
+	Started time.Time `json:"started"` // When that process took the lock
+}
+
+// acquireTempLock claims tempFile for this process and returns a function that releases it.
+// A lock left behind by a process that is no longer running is taken over, as is one with
+// this process's ID that it does not hold, left by an earlier process given the same ID.
+func acquireTempLock(tempFile string) (func(), error) {
+	lockPath := tempFile + tempLockSuffix
+	heldLocks.Lock()
+	defer heldLocks.Unlock()
+	if heldLocks.paths[lockPath] {
+		return nil, fmt.Errorf("%w: pid %d, this process", ErrDownloadInProgress, os.Getpid())
+	}
+
+	data, err := json.Marshal(tempLock{PID: os.Getpid(), Started: time.Now()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode lock: %w", err)
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, werr := f.Write(data)
+			cerr := f.Close()
+			if werr != nil || cerr != nil {
+				os.Remove(lockPath)
+				return nil, fmt.Errorf("could not write lock file %s: %w", lockPath, errors.Join(werr, cerr))
+			}
+			heldLocks.paths[lockPath] = true
+			return func() {
+				heldLocks.Lock()
+				defer heldLocks.Unlock()
+				delete(heldLocks.paths, lockPath)
+				os.Remove(lockPath)
+			}, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("could not create lock file %s: %w", lockPath, err)
+		}
+
+		var owner tempLock
+		if raw, err := os.ReadFile(lockPath); err == nil && json.Unmarshal(raw, &owner) == nil {
+			if owner.PID != os.Getpid() && processAlive(owner.PID) {
+				return nil, fmt.Errorf("%w: pid %d since %s", ErrDownloadInProgress,
+					owner.PID, owner.Started.Format(time.RFC3339))
+			}
+		}
+
+		slog.Default().Info("Removing stale download lock",
+			"path", lockPath,
+			"pid", owner.PID)
+		if err := os.Remove(lockPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("could not remove stale lock %s: %w", lockPath, err)
+		}
+	}
+
+	return nil, fmt.Errorf("%w: lost race for %s", ErrDownloadInProgress, lockPath)
+}
@@ -0,0 +1,42 @@
+package wmse
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAcquireTempLock(t *testing.T) {
+	tempFile := filepath.Join(t.TempDir(), "2024-01-01_ded.mp3") + tempSuffix
+
+	// A lock with this process's ID that it does not hold was left by an earlier process
+	stale, err := json.Marshal(tempLock{PID: os.Getpid(), Started: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tempFile+tempLockSuffix, stale, 0644); err != nil {
+		t.Fatal(err)
+	}
+	release, err := acquireTempLock(tempFile)
+	if err != nil {
+		t.Fatalf("stale lock with this process's ID not taken over: %v", err)
+	}
+
+	// Another worker of this process must not take the lock while it is held
+	if _, err := acquireTempLock(tempFile); !errors.Is(err, ErrDownloadInProgress) {
+		t.Fatalf("second acquire of a held lock = %v, want ErrDownloadInProgress", err)
+	}
+
+	release()
+	if _, err := os.Stat(tempFile + tempLockSuffix); !os.IsNotExist(err) {
+		t.Errorf("lock file left after release: %v", err)
+	}
+	release, err = acquireTempLock(tempFile)
+	if err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+	release()
+}
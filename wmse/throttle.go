@@ -0,0 +1,96 @@
+// throttle.go
+//
+// Support for -adaptive-delay. The time each request takes to return its response headers
+// is measured, and when it climbs past a threshold (a sign the server is under strain) the
+// delay between downloads is doubled; once responses are quick again it is brought back
+// down a step at a time to the configured -delay.
+
+package wmse
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultLatencyHigh is the response time above which the delay is increased
+	defaultLatencyHigh = 3 * time.Second
+	// defaultLatencyLow is the response time below which the delay is eased back
+	defaultLatencyLow = 500 * time.Millisecond
+	// defaultMaxAdaptiveDelay caps how far the delay can grow
+	defaultMaxAdaptiveDelay = 2 * time.Minute
+	// adaptiveDelayStep is how much the delay falls after each quick response
+	adaptiveDelayStep = time.Second
+)
+
+// latencyThrottle adjusts the delay between downloads from observed response times
+type latencyThrottle struct {
+	mu       sync.Mutex
+	base     time.Duration // Configured -delay, never gone below
+	limit    time.Duration // Longest delay allowed
+	high     time.Duration
+	low      time.Duration
+	delay    time.Duration
+	throttle bool // Whether the delay is currently above base
+}
+
+// newLatencyThrottle returns a throttle starting at base
+func newLatencyThrottle(base, high, low, limit time.Duration) *latencyThrottle {
+	return &latencyThrottle{base: base, limit: max(base, limit), high: high, low: low, delay: base}
+}
+
+// current returns the delay to use now
+func (t *latencyThrottle) current() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.delay
+}
+
+// observe records the response time of one request and adjusts the delay
+func (t *latencyThrottle) observe(latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch {
+	case latency > t.high:
+		t.delay = min(t.limit, max(2*t.delay, adaptiveDelayStep))
+	case latency < t.low && t.delay > t.base:
+		t.delay = max(t.base, t.delay-adaptiveDelayStep)
+	default:
+		return
+	}
+
+	switch {
+	case t.delay > t.base && !t.throttle:
+		t.throttle = true
+		slog.Default().Warn("Server is responding slowly, increasing delay between downloads",
+			"latency", latency.Round(time.Millisecond),
+			"delay", t.delay)
+	case t.delay == t.base && t.throttle:
+		t.throttle = false
+		slog.Default().Info("Server response times back to normal, delay restored",
+			"delay", t.delay)
+	default:
+		slog.Default().Debug("Adjusted adaptive delay",
+			"latency", latency.Round(time.Millisecond),
+			"delay", t.delay)
+	}
+}
+
+// latencyClient reports the time each request takes to return response headers
+type latencyClient struct {
+	throttle *latencyThrottle
+	base     HTTPClient
+}
+
+// Do sends req and records how long the response headers took
+func (c *latencyClient) Do(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := c.base.Do(req)
+	if err == nil {
+		c.throttle.observe(time.Since(start))
+	}
+	return resp, err
+}
@@ -0,0 +1,146 @@
+// timings.go
+//
+// Support for -timings, which breaks each download down into DNS lookup, connection,
+// TLS handshake, time to first byte and body transfer using net/http/httptrace, and
+// totals the phases at the end of the run.
+
+package wmse
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// requestTimings is the phase breakdown of one download
+type requestTimings struct {
+	DNS      time.Duration // Resolving the host name
+	Connect  time.Duration // Establishing the TCP connection
+	TLS      time.Duration // TLS handshake
+	TTFB     time.Duration // From sending the request to the first response byte
+	Transfer time.Duration // Reading the response body
+	Reused   bool          // An idle connection was reused, so there was no DNS/connect/TLS
+}
+
+// requestTrace records phase timings for a single request
+type requestTrace struct {
+	mu           sync.Mutex
+	timings      requestTimings
+	start        time.Time
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+}
+
+// trace returns req with an httptrace attached that records into t
+func (t *requestTrace) trace(req *http.Request) *http.Request {
+	t.start = time.Now()
+	ct := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			t.timings.Reused = info.Reused
+			t.mu.Unlock()
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			t.mu.Lock()
+			t.dnsStart = time.Now()
+			t.mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.mu.Lock()
+			t.timings.DNS = time.Since(t.dnsStart)
+			t.mu.Unlock()
+		},
+		ConnectStart: func(string, string) {
+			t.mu.Lock()
+			if t.connectStart.IsZero() {
+				t.connectStart = time.Now()
+			}
+			t.mu.Unlock()
+		},
+		ConnectDone: func(_, _ string, err error) {
+			t.mu.Lock()
+			if err == nil {
+				t.timings.Connect = time.Since(t.connectStart)
+			}
+			t.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			t.mu.Lock()
+			t.tlsStart = time.Now()
+			t.mu.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.mu.Lock()
+			t.timings.TLS = time.Since(t.tlsStart)
+			t.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			t.timings.TTFB = time.Since(t.start)
+			t.mu.Unlock()
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), ct))
+}
+
+// result returns the recorded timings with the body transfer time filled in
+func (t *requestTrace) result(transfer time.Duration) requestTimings {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	timings := t.timings
+	timings.Transfer = transfer
+	return timings
+}
+
+// timingCollector gathers the timings of every download in a run
+type timingCollector struct {
+	mu    sync.Mutex
+	total requestTimings
+	count int
+}
+
+// add records the timings of one download
+func (c *timingCollector) add(filename string, t requestTimings) {
+	slog.Default().Info("Download timings",
+		"filename", filename,
+		"dns", t.DNS.Round(time.Millisecond),
+		"connect", t.Connect.Round(time.Millisecond),
+		"tls", t.TLS.Round(time.Millisecond),
+		"ttfb", t.TTFB.Round(time.Millisecond),
+		"transfer", t.Transfer.Round(time.Millisecond),
+		"reused_connection", t.Reused)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.total.DNS += t.DNS
+	c.total.Connect += t.Connect
+	c.total.TLS += t.TLS
+	c.total.TTFB += t.TTFB
+	c.total.Transfer += t.Transfer
+	c.count++
+}
+
+// report logs the totals and averages across all recorded downloads
+func (c *timingCollector) report() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.count == 0 {
+		return
+	}
+
+	n := time.Duration(c.count)
+	overhead := c.total.DNS + c.total.Connect + c.total.TLS + c.total.TTFB
+	slog.Default().Info("Timing summary",
+		"downloads", c.count,
+		"avg_dns", (c.total.DNS / n).Round(time.Millisecond),
+		"avg_connect", (c.total.Connect / n).Round(time.Millisecond),
+		"avg_tls", (c.total.TLS / n).Round(time.Millisecond),
+		"avg_ttfb", (c.total.TTFB / n).Round(time.Millisecond),
+		"avg_transfer", (c.total.Transfer / n).Round(time.Millisecond),
+		"total_overhead", overhead.Round(time.Millisecond),
+		"total_transfer", c.total.Transfer.Round(time.Millisecond))
+}
@@ -0,0 +1,52 @@
+// transport.go
+//
+// The HTTP transport shared by every request. One transport means one connection pool, so
+// the many small API requests and the downloads reuse connections, and proxy settings,
+// whether from -proxy or the standard HTTP_PROXY, HTTPS_PROXY and NO_PROXY variables,
+// apply everywhere.
+
+package wmse
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// maxIdleConnsPerHost keeps enough idle connections for every worker of a parallel run
+const maxIdleConnsPerHost = 16
+
+// fallbackTransport backs the clients used when downloadOptions was built without any, so
+// even those share a pool
+var fallbackTransport = pooledTransport()
+
+// pooledTransport returns a keep-alive transport sized for this program's traffic: a handful
+// of hosts, each asked for many small JSON and HTML documents and a few large MP3s
+func pooledTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	transport.IdleConnTimeout = 90 * time.Second
+	return transport
+}
+
+// NewTransport returns a transport that sends requests through proxy, or, if proxy is
+// empty, through whatever proxy the environment names
+func NewTransport(proxy string) (*http.Transport, error) {
+	transport := pooledTransport()
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q", proxy)
+		}
+		switch u.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q (want http, https or socks5)", u.Scheme)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+
+	return transport, nil
+}
@@ -0,0 +1,177 @@
+// verify.go
+//
+// Support for -final-verify. Every download is hashed as it streams to disk; after the
+// run the files are read back and hashed again, in parallel, to confirm that what now
+// sits on disk matches what was received.
+
+package wmse
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultVerifyConcurrency is the number of files hashed at once when -verify-concurrency
+// is not set: one per CPU, which keeps an SSD busy without swamping a spinning disk much
+func defaultVerifyConcurrency() int {
+	return runtime.NumCPU()
+}
+
+// hashRecorder remembers the SHA-256 streamed for each file downloaded in this run
+type hashRecorder struct {
+	mu     sync.Mutex
+	hashes map[string]string
+}
+
+// record stores the hash received for path
+func (r *hashRecorder) record(path, sum string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.hashes == nil {
+		r.hashes = make(map[string]string)
+	}
+	r.hashes[path] = sum
+}
+
+// hashFile returns the hex SHA-256 of the file at path, reading it in a stream
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyMismatch describes a file whose content no longer matches its recorded hash
+type verifyMismatch struct {
+	path     string
+	expected string
+	actual   string
+	err      error
+}
+
+// checkHashes re-hashes every file in expected, which maps a name to its hex SHA-256, using
+// up to concurrency workers. location gives the path of the file with each name. It returns
+// the files that could not be read or no longer match, ordered by name.
+func checkHashes(expected map[string]string, location func(name string) string, concurrency int) []verifyMismatch {
+	jobs := make(chan string)
+	var mu sync.Mutex
+	var mismatches []verifyMismatch
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range jobs {
+				actual, err := hashFile(location(name))
+				if err != nil || actual != expected[name] {
+					mu.Lock()
+					mismatches = append(mismatches, verifyMismatch{path: name, expected: expected[name], actual: actual, err: err})
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for name := range expected {
+		jobs <- name
+	}
+	close(jobs)
+	wg.Wait()
+
+	slices.SortFunc(mismatches, func(a, b verifyMismatch) int {
+		return strings.Compare(a.path, b.path)
+	})
+	return mismatches
+}
+
+// finalVerify re-hashes every recorded file using up to concurrency workers and logs
+// each mismatch. It returns the number of files that failed verification.
+func (r *hashRecorder) finalVerify(concurrency int) int {
+	logger := slog.Default()
+	r.mu.Lock()
+	hashes := maps.Clone(r.hashes)
+	r.mu.Unlock()
+
+	start := time.Now()
+	mismatches := checkHashes(hashes, func(path string) string { return path }, concurrency)
+	for _, m := range mismatches {
+		if m.err != nil {
+			logger.Error("Could not verify file",
+				"path", m.path,
+				"error", m.err)
+			continue
+		}
+		logger.Error("File does not match downloaded content",
+			"path", m.path,
+			"expected_sha256", m.expected,
+			"actual_sha256", m.actual)
+	}
+
+	logger.Info("Final verification complete",
+		"files", len(hashes),
+		"failed", len(mismatches),
+		"elapsed", time.Since(start).Round(time.Millisecond))
+
+	return len(mismatches)
+}
+
+// hashDirectory hashes every regular .mp3 file under dir, using up to concurrency workers,
+// and returns the path of each file keyed by its hex SHA-256
+func hashDirectory(dir string, concurrency int) (map[string]string, error) {
+	logger := slog.Default()
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+
+	jobs := make(chan string)
+	var mu sync.Mutex
+	byHash := make(map[string]string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range jobs {
+				sum, err := hashFile(path)
+				if err != nil {
+					logger.Warn("Could not hash existing file", "path", path, "error", err)
+					continue
+				}
+				mu.Lock()
+				byHash[sum] = path
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// A -template may put episodes in subdirectories
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type().IsRegular() && strings.EqualFold(filepath.Ext(entry.Name()), ".mp3") {
+			jobs <- path
+		}
+		return nil
+	})
+	close(jobs)
+	wg.Wait()
+
+	return byHash, err
+}
@@ -0,0 +1,1681 @@
+// wmse.go
+//
+// A gentle downloader for WMSE MP3 archives. It first gets the show ID from the program page,
+// then fetches archive links from the API, and finally downloads each MP3 file with a pause
+// between requests to avoid overloading the server.
+
+// Package wmse downloads WMSE radio show archives.
+// It fetches MP3 files from the WMSE archive API and saves them locally.
+// The package includes features for:
+// - Validating show IDs
+// - Fetching archive links
+// - Downloading MP3 files with progress tracking
+// - Handling retries and errors
+// - Skipping already downloaded files
+// - Attaching playlist information to MP3 files
+//
+// Most programs need only a [Downloader], created with [New].
+package wmse
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+	_ "time/tzdata" // Options.Timezone must work on systems without a zoneinfo database
+
+	"golang.org/x/net/html"
+)
+
+// Constants for validation and limits
+const (
+	// maxShowIDLength is the maximum allowed length for a show ID
+	maxShowIDLength = 50
+	// maxResponseSize is the maximum allowed size for API responses (10MB)
+	maxResponseSize = 10 * 1024 * 1024
+	// maxFileSize is the default maximum size for downloaded MP3 files (500MB)
+	maxFileSize = 500 * 1024 * 1024
+	// maxArchiveLinks is the maximum number of archive links to process
+	maxArchiveLinks = 1000
+	// validShowIDRegex is the regular expression pattern for valid show IDs
+	validShowIDRegex = `^[a-zA-Z0-9_-]+$`
+	// defaultBaseURL is the base URL for the WMSE website
+	defaultBaseURL = "https://wmse.org"
+	// defaultAPIURL is the base URL for the WMSE API
+	defaultAPIURL = "https://wmse.fly.dev"
+	// tempSuffix is appended to a file's name while it is being downloaded
+	tempSuffix = ".tmp"
+	// MinFilenameLength is the smallest accepted Options.MaxFilenameLength, leaving room for
+	// a shortened name and the suffixes of the files written beside it
+	MinFilenameLength = 48
+)
+
+// Error definitions for the application
+var (
+	// ErrInvalidShowID is returned when the show ID is invalid
+	ErrInvalidShowID = errors.New("invalid show ID")
+	// ErrInvalidArchiveID is returned when an archive ID is invalid
+	ErrInvalidArchiveID = errors.New("invalid archive ID")
+	// ErrResponseTooLarge is returned when the API response is too large
+	ErrResponseTooLarge = errors.New("response too large")
+	// ErrFileTooLarge is returned when the downloaded file is too large
+	ErrFileTooLarge = errors.New("file too large")
+	// ErrInvalidContentType is returned when the content type is invalid
+	ErrInvalidContentType = errors.New("invalid content type")
+	// ErrTooManyLinks is returned when too many archive links are found
+	ErrTooManyLinks = errors.New("too many archive links")
+	// ErrNoArchiveURL is returned when an archive has no MP3 URL yet
+	ErrNoArchiveURL = errors.New("no MP3 URL available")
+	// ErrNotDirectory is returned when the output path exists but is not a directory
+	ErrNotDirectory = errors.New("not a directory")
+	// ErrIndexOutOfRange is returned when a range given to SliceArchives falls outside the list
+	ErrIndexOutOfRange = errors.New("index out of range")
+	// ErrArchiveIDNotFound is returned when the program page loaded but had no archive ID
+	ErrArchiveIDNotFound = errors.New("archive ID not found on program page")
+)
+
+// Archive represents a WMSE show archive entry
+type Archive struct {
+	ShowID       string    `json:"show_id"`       // Unique identifier for the show
+	ArchiveURL   string    `json:"archive_url"`   // URL to the MP3 archive
+	PlaylistID   *string   `json:"playlist_id"`   // Optional playlist ID
+	PlaylistDate string    `json:"playlist_date"` // Date of the show as the API gave it
+	Date         time.Time `json:"-"`             // PlaylistDate parsed in the station's time zone; zero if it could not be parsed
+	SHA256       string    `json:"sha256"`        // Content hash, when the listing provides one
+	Title        string    `json:"title"`         // Episode title, if the API provides one
+	Description  string    `json:"description"`   // Episode description, if the API provides one
+	Name         string    `json:"show_name"`     // Name of the show, if the API provides one
+}
+
+// ParsedDate returns the date of the show. Archives from a Downloader already carry it in
+// Date; for any other archive PlaylistDate is parsed, as UTC if it has no offset.
+func (a Archive) ParsedDate() (time.Time, error) {
+	return archiveDateIn(a, nil)
+}
+
+// HTTPClient sends HTTP requests. *http.Client satisfies it; tests can pass a stub or a
+// client pointed at an httptest.Server.
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+const (
+	// defaultAPITimeout bounds requests for pages, archive lists and playlists
+	defaultAPITimeout = 30 * time.Second
+	// defaultDownloadTimeout bounds a single MP3 download
+	defaultDownloadTimeout = 30 * time.Minute
+)
+
+// playlistDateLayouts are the date formats seen in the API's playlist_date field
+var playlistDateLayouts = []string{
+	"2006-01-02",
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+}
+
+// defaultTimezone is the station's local time zone, in which playlist dates are given
+const defaultTimezone = "America/Chicago"
+
+// futureDateTolerance is how far past the current time a playlist date may be before it is
+// reported; episodes are often listed a little ahead of broadcast
+const futureDateTolerance = 7 * 24 * time.Hour
+
+// parsePlaylistDate parses a playlist_date value in any of the known layouts. Dates without
+// an explicit offset are taken to be in loc, the station's time zone, and all results are
+// returned in it, so comparisons line up with the broadcast calendar across DST changes.
+func parsePlaylistDate(value string, loc *time.Location) (time.Time, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	for _, layout := range playlistDateLayouts {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t.In(loc), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognised playlist date %q", value)
+}
+
+// archiveDateIn returns the date of archive in loc, parsing PlaylistDate if Date is unset
+func archiveDateIn(archive Archive, loc *time.Location) (time.Time, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	if !archive.Date.IsZero() {
+		return archive.Date.In(loc), nil
+	}
+	return parsePlaylistDate(archive.PlaylistDate, loc)
+}
+
+// setArchiveDates parses the playlist date of each archive into its Date field, reading
+// dates without an offset in loc
+func setArchiveDates(archives []Archive, loc *time.Location) {
+	for i := range archives {
+		date, err := parsePlaylistDate(archives[i].PlaylistDate, loc)
+		if err != nil {
+			slog.Default().Debug("Could not parse playlist date",
+				"date", archives[i].PlaylistDate,
+				"url", archives[i].ArchiveURL)
+			continue
+		}
+		archives[i].Date = date
+	}
+}
+
+// warnFutureDates logs archives dated further ahead than futureDateTolerance. They are
+// still downloaded; the warning only flags a likely mistake in the listing.
+func warnFutureDates(archives []Archive, now time.Time, loc *time.Location) {
+	for _, archive := range archives {
+		date, err := archiveDateIn(archive, loc)
+		if err != nil || date.Sub(now) <= futureDateTolerance {
+			continue
+		}
+		slog.Default().Warn("Archive is dated in the future",
+			"date", archive.PlaylistDate,
+			"url", archive.ArchiveURL)
+	}
+}
+
+// downloadOptions controls how downloadShow fetches and stores archives
+type downloadOptions struct {
+	OutputDir         string             // Directory to save MP3 files
+	Delay             time.Duration      // Pause after each completed download
+	Debug             bool               // Log detailed download progress
+	MaxFilenameLength int                // Maximum length of generated file names in bytes
+	LogSkips          bool               // Log each file skipped because it already exists
+	HideProgress      bool               // Suppress the per-file progress bar
+	ProgressMode      string             // How progress is reported: bar, log, line or none
+	ProgressInterval  time.Duration      // How often the log and line progress modes report
+	BytesReceived     *atomic.Int64      // Optional counter of bytes received, shared between downloads
+	Timings           *timingCollector   // Optional collector of per-download phase timings
+	FetchLinks        bool               // Download resources linked from the playlist
+	Strict            bool               // Fail downloads whose playlist or extras could not be saved
+	SkipMissingURL    bool               // Treat archives without an MP3 URL as pending rather than failed
+	Retries           RetryPolicy        // How many times to retry each kind of failure
+	Hashes            *hashRecorder      // Optional record of the SHA-256 of each completed download
+	Checksums         *checksumLog       // Optional manifest each completed download is added to
+	State             *downloadState     // Optional record of completed downloads, consulted before downloading
+	Force             bool               // Download every archive again, ignoring State and existing files
+	Replace           map[string]bool    // Optional archives, by state key, to download again as if forced
+	Overwrite         string             // What to do with archives already downloaded: one of OverwriteModes
+	MaxFileSize       int64              // Largest archive accepted, in bytes (maxFileSize if 0)
+	PlaylistTemplate  *template.Template // Renders each playlist track as a line of text
+	PlaylistFormat    string             // Format of saved playlist files: one of PlaylistFormats
+	Backoff           Backoff            // Delay between download retries
+	Pacer             *pacer             // Optional shared spacing of download starts, replacing Delay
+	NoAtomic          bool               // Write straight to the final path instead of a temp file and rename
+	GlobalStore       string             // Optional content-addressed store that downloads are linked into
+	ExistingHashes    map[string]string  // Optional paths of files already in OutputDir, keyed by SHA-256
+	MetaSidecar       bool               // Write a .meta.json provenance record next to each file
+	Throttle          *latencyThrottle   // Optional adaptive replacement for Delay
+	Hosts             *hostLimiter       // Optional cap on distinct hosts downloaded from at once
+	Bandwidth         *bandwidthLimiter  // Optional cap on download throughput, shared by all downloads
+	DelayOnSkip       bool               // Also pause after archives skipped because they are already present
+	Tags              bool               // Write show details and the playlist into the MP3 as ID3 tags
+	Chapters          bool               // Write the playlist into the MP3 as ID3 chapters when it has track times
+	SetMtime          bool               // Date each saved MP3 by its air date rather than when it was downloaded
+	KeepFailed        bool               // Keep downloads rejected for their content type or size as <name>.failed
+	Client            HTTPClient         // Sends download requests; a default client is used if nil
+	APIClient         HTTPClient         // Sends playlist and other API requests; a default client is used if nil
+	Metrics           *runMetrics        // Optional live counters served by -metrics-addr
+	Breaker           *circuitBreaker    // Optional pause for the whole run after repeated failures
+	Seen              *runURLs           // Optional record of URLs saved this run, to link repeats instead of downloading
+	Location          *time.Location     // Time zone playlist dates are read in
+	FilenameTemplate  *template.Template // Optional template for the path of each file under OutputDir
+	BaseURL           string             // WMSE website that program pages are read from; defaultBaseURL if empty
+	APIURL            string             // WMSE API that archive lists and playlists are read from; defaultAPIURL if empty
+}
+
+// Result describes what a download did with one archive
+type Result struct {
+	Skipped   bool   // The file was already present, or was linked to a copy saved earlier in the run
+	Path      string // Where the archive is saved
+	Bytes     int64  // Size of the downloaded file, including any resumed part
+	Retries   int    // Attempts that failed before the last one
+	RequestID string // ID a transport gave the last request for the archive, if it gave one
+}
+
+// waitAfterSkip applies the inter-download delay after a skipped archive when DelayOnSkip
+// is set. By default skips are not delayed, since they make no request to the server. The
+// wait ends early if ctx does.
+func (o downloadOptions) waitAfterSkip(ctx context.Context) {
+	if !o.DelayOnSkip {
+		return
+	}
+	if o.Pacer != nil {
+		o.Pacer.wait(ctx)
+		return
+	}
+	sleepContext(ctx, o.delay())
+}
+
+// downloadClient returns the client for MP3 downloads
+func (o downloadOptions) downloadClient() HTTPClient {
+	if o.Client != nil {
+		return o.Client
+	}
+	return &http.Client{Timeout: defaultDownloadTimeout, Transport: fallbackTransport}
+}
+
+// apiClient returns the client for API, playlist and link requests
+func (o downloadOptions) apiClient() HTTPClient {
+	if o.APIClient != nil {
+		return o.APIClient
+	}
+	return &http.Client{Timeout: defaultAPITimeout, Transport: fallbackTransport}
+}
+
+// baseURL returns the WMSE website to read program pages from
+func (o downloadOptions) baseURL() string {
+	if o.BaseURL != "" {
+		return o.BaseURL
+	}
+	return defaultBaseURL
+}
+
+// apiURL returns the WMSE API to read archive lists and playlists from
+func (o downloadOptions) apiURL() string {
+	if o.APIURL != "" {
+		return o.APIURL
+	}
+	return defaultAPIURL
+}
+
+// delay returns the pause to leave between downloads
+func (o downloadOptions) delay() time.Duration {
+	if o.Throttle != nil {
+		return o.Throttle.current()
+	}
+	return o.Delay
+}
+
+// validateShowID ensures the show ID meets security requirements
+func validateShowID(id string) error {
+	if id == "" || len(id) > maxShowIDLength {
+		return fmt.Errorf("%w: empty or too long", ErrInvalidShowID)
+	}
+
+	matched, err := regexp.MatchString(validShowIDRegex, id)
+	if err != nil || !matched {
+		return fmt.Errorf("%w: contains invalid characters", ErrInvalidShowID)
+	}
+
+	return nil
+}
+
+// ValidateArchiveID checks an archive ID is safe to use in an API URL
+func ValidateArchiveID(id string) error {
+	if id == "" || len(id) > maxShowIDLength {
+		return fmt.Errorf("%w: empty or too long", ErrInvalidArchiveID)
+	}
+
+	matched, err := regexp.MatchString(validShowIDRegex, id)
+	if err != nil || !matched {
+		return fmt.Errorf("%w: contains invalid characters", ErrInvalidArchiveID)
+	}
+
+	return nil
+}
+
+// validateServiceURL checks that raw is an absolute http or https URL and returns it
+// without a trailing slash, ready for paths to be appended
+func validateServiceURL(name, raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", fmt.Errorf("invalid %s URL %q (want an http or https URL)", name, raw)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("invalid %s URL %q: query strings and fragments are not supported", name, raw)
+	}
+	return strings.TrimRight(raw, "/"), nil
+}
+
+// validateOutputDir checks that dir is a directory, or could be created as one
+func validateOutputDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("output path %s: %w", dir, ErrNotDirectory)
+		}
+		return nil
+	}
+
+	// The directory will be created later, so the nearest existing ancestor must be a directory
+	for parent := filepath.Dir(dir); ; parent = filepath.Dir(parent) {
+		if info, statErr := os.Stat(parent); statErr == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("cannot create output directory %s because %s: %w", dir, parent, ErrNotDirectory)
+			}
+			break
+		}
+		if parent == filepath.Dir(parent) {
+			break
+		}
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not check output path: %w", err)
+	}
+	return nil
+}
+
+// renameFile moves a finished temporary file into place; tests replace it to simulate a crash
+var renameFile = os.Rename
+
+// WriteFileAtomic writes data to path as the package writes its own records, through a
+// temporary file and a rename, so a crash part-way through leaves the old content intact
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	return writeFileAtomic(path, data, perm)
+}
+
+// writeFileAtomic writes data to path via a temporary file in the same directory and a rename,
+// so readers (and a crash part-way through) see either the old content or the new, never a mix
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+atomicTempPattern)
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, perm)
+	}
+	if err == nil {
+		err = renameFile(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
+
+// archiveFilename returns the path, relative to the output directory, an archive is saved
+// to. Without a FilenameTemplate this is a filename made from the show date and ID.
+func (o downloadOptions) archiveFilename(archive Archive) string {
+	if o.FilenameTemplate != nil {
+		name, err := renderFilename(o.FilenameTemplate, archive, o.MaxFilenameLength)
+		if err == nil {
+			return name
+		}
+		slog.Default().Warn("Falling back to the default filename", "error", err)
+	}
+	filename := fmt.Sprintf("%s_%s.mp3", archive.PlaylistDate, archive.ShowID)
+	return sanitizeFilename(filename, o.MaxFilenameLength)
+}
+
+// programPage is a show's program page as fetched from the WMSE website
+type programPage struct {
+	URL string     // Address the page was fetched from
+	Raw []byte     // Page HTML exactly as received
+	Doc *html.Node // Parsed page
+}
+
+const (
+	// scrapeAttempts is how many times the program page is fetched while it lacks an archive ID
+	scrapeAttempts = 3
+	// scrapeRetryDelay is the wait before the first refetch, doubling after each one
+	scrapeRetryDelay = 2 * time.Second
+	// pageSnippetLength is how much of a page without an archive ID is logged for debugging
+	pageSnippetLength = 2048
+)
+
+// getShowArchiveID gets the archive ID from the program page. The page itself is
+// returned too so callers can reuse it without fetching it again. The page sometimes
+// loads the wmse-archive element lazily, so a page without one is fetched again a few
+// times before giving up with ErrArchiveIDNotFound; network failures are returned at once.
+func getShowArchiveID(ctx context.Context, client HTTPClient, site, showID string) (string, *programPage, error) {
+	logger := slog.Default()
+
+	delay := scrapeRetryDelay
+	for attempt := 1; ; attempt++ {
+		archiveID, page, err := scrapeArchiveID(ctx, client, site, showID)
+		if !errors.Is(err, ErrArchiveIDNotFound) {
+			return archiveID, page, err
+		}
+
+		if attempt >= scrapeAttempts {
+			if page != nil {
+				snippet := page.Raw[:min(len(page.Raw), pageSnippetLength)]
+				logger.Debug("Program page without an archive ID",
+					"url", page.URL,
+					"bytes", len(page.Raw),
+					"html", string(snippet))
+			}
+			return "", page, fmt.Errorf("%w, after %d attempts; the page layout may have changed", err, attempt)
+		}
+
+		logger.Info("Archive ID not on program page yet, fetching it again",
+			"attempt", attempt,
+			"delay", delay)
+		if err := sleepContext(ctx, delay); err != nil {
+			return "", page, err
+		}
+		delay *= 2
+	}
+}
+
+// scrapeArchiveID fetches the program page once and looks for the archive ID on it
+func scrapeArchiveID(ctx context.Context, client HTTPClient, site, showID string) (string, *programPage, error) {
+	logger := slog.Default()
+
+	page, err := fetchProgramPage(ctx, client, site, showID)
+	if err != nil {
+		return "", nil, err
+	}
+
+	archiveID, strategy := extractArchiveID(page.Doc)
+	if archiveID == "" {
+		// Some servers redirect with a meta refresh rather than a 3xx; follow one hop
+		target := metaRefreshURL(page.Doc, page.URL)
+		if target == "" {
+			return "", page, fmt.Errorf("%w: no <wmse-archive show-id> element or fallback match", ErrArchiveIDNotFound)
+		}
+
+		logger.Info("Following meta refresh on program page",
+			"from", page.URL,
+			"to", target)
+		page, err = fetchPage(ctx, client, target)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to follow meta refresh: %w", err)
+		}
+		archiveID, strategy = extractArchiveID(page.Doc)
+		if archiveID == "" {
+			return "", page, fmt.Errorf("%w after meta refresh to %s", ErrArchiveIDNotFound, target)
+		}
+	}
+
+	if strategy != archiveIDStrategies[0].name {
+		// The expected markup has gone; worth noticing before the fallbacks stop working too
+		logger.Warn("Archive ID found by a fallback strategy; the program page markup may have changed",
+			"strategy", strategy)
+	}
+	logger.Info("Found archive ID", "id", archiveID, "strategy", strategy)
+	return archiveID, page, nil
+}
+
+// fetchProgramPage downloads and parses a show's program page
+func fetchProgramPage(ctx context.Context, client HTTPClient, site, showID string) (*programPage, error) {
+	// Validate show ID
+	if err := validateShowID(showID); err != nil {
+		return nil, err
+	}
+
+	return fetchPage(ctx, client, fmt.Sprintf("%s/program/%s/", site, showID))
+}
+
+// fetchPage downloads and parses the HTML page at pageURL
+func fetchPage(ctx context.Context, client HTTPClient, pageURL string) (*programPage, error) {
+	// Create request with context
+	req, err := http.NewRequestWithContext(ctx, "GET", pageURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// Add headers to look like a browser
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.4 Safari/605.1.15")
+	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
+
+	// Perform request
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch program page: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("program page returned non-200 status: %s", resp.Status)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read program page: %w", err)
+	}
+	if len(raw) > maxResponseSize {
+		return nil, fmt.Errorf("%w: program page", ErrResponseTooLarge)
+	}
+
+	// Parse HTML
+	doc, err := html.Parse(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse HTML: %w", err)
+	}
+
+	return &programPage{URL: pageURL, Raw: raw, Doc: doc}, nil
+}
+
+// metaRefreshURL returns the absolute target of a <meta http-equiv="refresh"> redirect
+// in doc, resolved against pageURL, or "" if the page has none
+func metaRefreshURL(doc *html.Node, pageURL string) string {
+	var content string
+	var f func(*html.Node)
+	f = func(n *html.Node) {
+		if content != "" {
+			return
+		}
+		if n.Type == html.ElementNode && n.Data == "meta" {
+			var refresh bool
+			var value string
+			for _, attr := range n.Attr {
+				switch attr.Key {
+				case "http-equiv":
+					refresh = strings.EqualFold(attr.Val, "refresh")
+				case "content":
+					value = attr.Val
+				}
+			}
+			if refresh {
+				content = value
+				return
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			f(c)
+		}
+	}
+	f(doc)
+
+	// The content looks like "0; url=https://example.org/", with the delay optional
+	_, target, ok := strings.Cut(content, ";")
+	if !ok {
+		target = content
+	}
+	target = strings.TrimSpace(target)
+	if len(target) < 4 || !strings.EqualFold(target[:4], "url=") {
+		return ""
+	}
+	target = strings.Trim(strings.TrimSpace(target[4:]), `"'`)
+	if target == "" {
+		return ""
+	}
+
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return ""
+	}
+	ref, err := url.Parse(target)
+	if err != nil {
+		return ""
+	}
+	resolved := base.ResolveReference(ref)
+	if resolved.Scheme != "http" && resolved.Scheme != "https" {
+		return ""
+	}
+	return resolved.String()
+}
+
+// findArchiveID finds the wmse-archive element and returns its show-id attribute
+func findArchiveID(doc *html.Node) string {
+	var archiveID string
+	var f func(*html.Node)
+	f = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "wmse-archive" {
+			for _, attr := range n.Attr {
+				if attr.Key == "show-id" {
+					archiveID = attr.Val
+					return
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			f(c)
+		}
+	}
+	f(doc)
+
+	return archiveID
+}
+
+// fetchArchives gets the list of archives from the API
+func fetchArchives(ctx context.Context, client HTTPClient, api, archiveID string) ([]Archive, error) {
+	logger := slog.Default()
+
+	// Create request with context
+	url := fmt.Sprintf("%s/api/shows/%s", api, archiveID)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// Add headers
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.4 Safari/605.1.15")
+
+	// Perform request
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch archives: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("API returned non-200 status: %s", resp.Status)
+	}
+
+	body, err := decodedBody(resp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archives: %w", err)
+	}
+	defer body.Close()
+
+	// Parse JSON response
+	var archives []Archive
+	if err := json.NewDecoder(body).Decode(&archives); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON response: %w", err)
+	}
+
+	logger.Info("Found archives",
+		"count", len(archives),
+		"archive_id", archiveID)
+
+	return archives, nil
+}
+
+// loadArchivesFile reads an archive list previously saved in the API's JSON format
+func loadArchivesFile(path string) ([]Archive, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open archives file: %w", err)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, maxResponseSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("could not read archives file: %w", err)
+	}
+	if len(data) > maxResponseSize {
+		return nil, fmt.Errorf("%w: %s", ErrResponseTooLarge, path)
+	}
+
+	var archives []Archive
+	if err := json.Unmarshal(data, &archives); err != nil {
+		return nil, fmt.Errorf("failed to parse archives file %s: %w", path, err)
+	}
+	if len(archives) > maxArchiveLinks {
+		return nil, fmt.Errorf("%w: %d", ErrTooManyLinks, len(archives))
+	}
+
+	slog.Default().Info("Loaded archives from file",
+		"count", len(archives),
+		"path", path)
+
+	return archives, nil
+}
+
+// SliceArchives returns archives[start:end], where an end of 0 means the end of the list
+func SliceArchives(archives []Archive, start, end int) ([]Archive, error) {
+	if end == 0 {
+		end = len(archives)
+	}
+
+	if start < 0 || start >= len(archives) {
+		return nil, fmt.Errorf("%w: start index %d, valid range is 0-%d", ErrIndexOutOfRange, start, len(archives)-1)
+	}
+	if end > len(archives) {
+		return nil, fmt.Errorf("%w: end index %d exceeds %d archives", ErrIndexOutOfRange, end, len(archives))
+	}
+	if end <= start {
+		return nil, fmt.Errorf("%w: end index %d must be greater than start index %d", ErrIndexOutOfRange, end, start)
+	}
+
+	return archives[start:end], nil
+}
+
+// DedupeArchives drops archives whose URL was already listed by an earlier entry, keeping
+// the first of each, and returns the dropped entries along with the kept ones. Archives
+// without a URL are all kept.
+func DedupeArchives(archives []Archive) (kept, duplicates []Archive) {
+	seen := make(map[string]bool, len(archives))
+	for _, archive := range archives {
+		if archive.ArchiveURL != "" && seen[archive.ArchiveURL] {
+			duplicates = append(duplicates, archive)
+			continue
+		}
+		seen[archive.ArchiveURL] = true
+		kept = append(kept, archive)
+	}
+	return kept, duplicates
+}
+
+// progressReader wraps an io.Reader to track progress
+type progressReader struct {
+	reader     io.Reader
+	onProgress func(written int64)
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.reader.Read(p)
+	if n > 0 {
+		if pr.onProgress != nil {
+			pr.onProgress(int64(n))
+		}
+	}
+	return n, err
+}
+
+// downloadShow downloads a single show's MP3 file and attaches playlist information if available.
+// It reports whether the download was skipped because the file already exists, and how
+// it went.
+func downloadShow(ctx context.Context, archive Archive, opts downloadOptions) (_ Result, err error) {
+	logger := slog.Default()
+
+	if archive.ArchiveURL == "" {
+		return Result{}, fmt.Errorf("%w for archive: %s", ErrNoArchiveURL, archive.ShowID)
+	}
+
+	filename := opts.archiveFilename(archive)
+	outputPath := filepath.Join(opts.OutputDir, filename)
+	result := Result{Path: outputPath}
+	if opts.Replace[stateKey(archive)] {
+		opts.Force = true
+	}
+
+	// The state file knows about downloads whatever they are now called
+	if opts.State != nil && !opts.Force {
+		if entry, ok := opts.State.lookup(archive); ok {
+			existing := filepath.Join(opts.OutputDir, filepath.FromSlash(entry.Path))
+			if opts.keepExisting(ctx, archive, existing) {
+				if opts.LogSkips {
+					logger.Info("Skipping archive recorded as downloaded", "filename", entry.Path)
+				}
+				opts.waitAfterSkip(ctx)
+				result.Skipped = true
+				result.Path = existing
+				return result, nil
+			}
+			opts.Force = true // Replace it below
+		}
+	}
+
+	// Check if file already exists
+	if info, err := os.Stat(outputPath); err == nil && !opts.Force {
+		if !info.Mode().IsRegular() {
+			return result, fmt.Errorf("target path %s exists but is not a regular file", outputPath)
+		}
+		if opts.keepExisting(ctx, archive, outputPath) {
+			if opts.LogSkips {
+				logger.Info("Skipping existing file", "filename", filename)
+			}
+			// Files from before the state file existed are added to it as they are found
+			if err := opts.recordState(archive, outputPath, "", 0); err != nil {
+				logger.Warn("Failed to record existing file in download state", "path", outputPath, "error", err)
+			}
+			opts.waitAfterSkip(ctx)
+			result.Skipped = true
+			return result, nil
+		}
+		opts.Force = true // Replace it below
+	}
+
+	// The same content may already be here under another name
+	if archive.SHA256 != "" && !opts.Force {
+		if existing, ok := opts.ExistingHashes[strings.ToLower(archive.SHA256)]; ok {
+			if opts.LogSkips {
+				logger.Info("Skipping archive already present under another name",
+					"filename", filename,
+					"existing", existing)
+			}
+			opts.waitAfterSkip(ctx)
+			result.Skipped = true
+			result.Path = existing
+			return result, nil
+		}
+	}
+
+	// Shared content listed twice in one run is linked rather than fetched again
+	if opts.Seen != nil {
+		if existing, ok := opts.Seen.lookup(archive.ArchiveURL); ok {
+			if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+				return result, fmt.Errorf("could not create output directory: %w", err)
+			}
+			if err := linkOrCopy(existing.path, outputPath); err != nil {
+				return result, fmt.Errorf("could not link %s to %s: %w", outputPath, existing.path, err)
+			}
+			logger.Info("Archive URL already downloaded in this run, linked instead of downloading",
+				"filename", filename,
+				"existing", existing.path,
+				"url", archive.ArchiveURL)
+			if err := opts.recordLinked(archive, outputPath, existing.sum); err != nil {
+				return result, err
+			}
+			opts.waitAfterSkip(ctx)
+			result.Skipped = true
+			return result, nil
+		}
+	}
+
+	// Ask for the size first so an oversized file is not fetched only to be thrown away
+	if err := opts.preflightSize(ctx, archive); err != nil {
+		return result, err
+	}
+
+	logger.Info("Downloading show",
+		"date", archive.PlaylistDate,
+		"url", archive.ArchiveURL)
+
+	// Create output directory if needed
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return result, fmt.Errorf("could not create output directory: %w", err)
+	}
+
+	// Stream to temporary file first, claiming it so other instances leave it alone
+	tempFile := outputPath + tempSuffix
+	release, err := acquireTempLock(tempFile)
+	if err != nil {
+		return result, err
+	}
+	defer release()
+
+	if opts.Pacer != nil {
+		if err := opts.Pacer.wait(ctx); err != nil {
+			return result, err
+		}
+	}
+
+	if opts.Hosts != nil {
+		if u, err := url.Parse(archive.ArchiveURL); err == nil {
+			defer opts.Hosts.acquire(u.Hostname())()
+		}
+	}
+
+	// With -no-atomic the download streams straight into the final file
+	writePath := tempFile
+	writeFile := writeFileAtomic
+	if opts.NoAtomic {
+		writePath = outputPath
+		writeFile = os.WriteFile
+	}
+
+	// An existing temp file is kept: it holds the start of an interrupted download. With
+	// -no-atomic and -force the file being written is the old download, so it starts empty.
+	flags := os.O_CREATE | os.O_RDWR
+	if opts.NoAtomic && opts.Force {
+		flags |= os.O_TRUNC
+	}
+	outFile, err := os.OpenFile(writePath, flags, 0644)
+	if err != nil {
+		return result, fmt.Errorf("could not create %s: %w", writePath, err)
+	}
+	sizePath := tempFile + partialSizeSuffix
+	complete := false
+	defer func() {
+		outFile.Close()
+		// A partial temp file is left for the next run to resume when the run was cancelled
+		// or the failure may pass, but not when the archive cannot be fetched as it is or
+		// nothing arrived. A partial file under the final name would be mistaken for a
+		// finished download. The lock is released either way.
+		if !complete && (opts.NoAtomic || !resumable(ctx, err, writePath)) {
+			os.Remove(writePath)
+		}
+		if _, err := os.Stat(writePath); complete || err != nil {
+			os.Remove(sizePath)
+		}
+	}()
+
+	// Retry logic for downloads, with a separate budget for each kind of error
+	hasher := sha256.New()
+	retries := make(map[errorClass]int)
+	meta := &downloadMeta{
+		SourceURL:  archive.ArchiveURL,
+		Started:    time.Now(),
+		PlaylistID: archive.PlaylistID,
+	}
+	var remoteModified time.Time // Last-Modified of the response that was saved
+	var lastErr error
+	restart := false
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && !restart {
+			class := classifyError(lastErr)
+			if !retryable(lastErr) || retries[class] >= opts.Retries.limit(class) {
+				break
+			}
+			retries[class]++
+			logger.Info("Retrying download",
+				"attempt", attempt,
+				"error_class", class,
+				"retry", retries[class],
+				"max_retries", opts.Retries.limit(class),
+				"previous_error", lastErr,
+				requestIDAttr(result.RequestID))
+			if err := sleepContext(ctx, retryDelay(opts.Backoff, attempt, lastErr)); err != nil {
+				lastErr = err
+				break
+			}
+		}
+		restart = false
+
+		// Pick up from whatever an earlier attempt or run left in the temp file
+		offset, err := outFile.Seek(0, io.SeekEnd)
+		if err != nil {
+			return result, fmt.Errorf("could not read temp file: %w", err)
+		}
+
+		// Create request with longer timeout, and room for a transport to note its ID
+		reqCtx, requestID := withRequestIDSlot(ctx)
+		req, err := http.NewRequestWithContext(reqCtx, "GET", archive.ArchiveURL, nil)
+		if err != nil {
+			lastErr = fmt.Errorf("failed to create request: %w", err)
+			continue
+		}
+		req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.4 Safari/605.1.15")
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+
+		var trace *requestTrace
+		if opts.Timings != nil {
+			trace = &requestTrace{}
+			req = trace.trace(req)
+		}
+
+		resp, err := opts.downloadClient().Do(req)
+		result.RequestID = requestID.get()
+		if err != nil {
+			lastErr = fmt.Errorf("failed to GET %s: %w", archive.ArchiveURL, err)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+
+		// A server size that differs from the one recorded with the partial, or is smaller
+		// than the partial, means the archive has been replaced since
+		start, size, hasRange := parseContentRange(resp.Header.Get("Content-Range"))
+		expected := int64(-1)
+		if offset > 0 {
+			expected = readPartialSize(sizePath)
+		}
+		stale := offset > 0 && hasRange && size >= 0 && (size < offset || (expected >= 0 && size != expected))
+		switch {
+		case resp.StatusCode == http.StatusOK:
+			// Full content, either as asked or because the server ignored the Range header
+			if offset > 0 {
+				logger.Info("Server does not support resuming, downloading from the start",
+					"filename", filename)
+			}
+			offset = 0
+		case stale && (resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable):
+			resp.Body.Close()
+			logger.Warn("Archive changed on the server since the partial download, starting again",
+				"filename", filename,
+				"partial_bytes", offset,
+				"expected_size", expected,
+				"server_size", size)
+			if err := outFile.Truncate(0); err != nil {
+				return result, fmt.Errorf("could not reset temp file: %w", err)
+			}
+			lastErr = &HTTPError{URL: archive.ArchiveURL, StatusCode: resp.StatusCode, Status: resp.Status}
+			restart = true
+			continue
+		case offset > 0 && resp.StatusCode == http.StatusPartialContent && hasRange && start == offset:
+			logger.Info("Resuming partial download",
+				"filename", filename,
+				"offset", offset)
+		case offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && hasRange && size == offset:
+			// The temp file already holds the whole archive
+			resp.Body.Close()
+			resp.ContentLength = 0
+			resp.Body = http.NoBody
+		case offset > 0 && (resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable):
+			// The partial file doesn't match what the server has; start again straight away
+			resp.Body.Close()
+			logger.Warn("Discarding partial download that cannot be resumed",
+				"filename", filename,
+				"status", resp.Status)
+			if err := outFile.Truncate(0); err != nil {
+				return result, fmt.Errorf("could not reset temp file: %w", err)
+			}
+			lastErr = &HTTPError{URL: archive.ArchiveURL, StatusCode: resp.StatusCode, Status: resp.Status}
+			restart = true
+			continue
+		default:
+			resp.Body.Close()
+			httpErr := &HTTPError{URL: archive.ArchiveURL, StatusCode: resp.StatusCode, Status: resp.Status}
+			if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+				httpErr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+				if httpErr.RetryAfter > 0 {
+					logger.Warn("Server asked us to slow down",
+						"url", archive.ArchiveURL,
+						"status", resp.Status,
+						"retry_after", httpErr.RetryAfter)
+				}
+			}
+			lastErr = httpErr
+			continue
+		}
+
+		// A CDN may answer 200 with an HTML error page
+		if resp.Body != http.NoBody {
+			if err := checkContentType(resp.Header.Get("Content-Type")); err != nil {
+				if opts.KeepFailed {
+					if err := keepFailedResponse(resp.Body, outputPath); err != nil {
+						logger.Warn("Could not keep failed response", "error", err)
+					}
+				}
+				resp.Body.Close()
+				lastErr = fmt.Errorf("unexpected response from %s: %w", archive.ArchiveURL, err)
+				continue
+			}
+		}
+
+		// Remember the full size, so a later resume can tell whether the archive changed
+		switch {
+		case resp.StatusCode == http.StatusOK && resp.ContentLength >= 0:
+			writePartialSize(sizePath, resp.ContentLength)
+		case resp.StatusCode == http.StatusPartialContent && size >= 0:
+			writePartialSize(sizePath, size)
+		}
+
+		// The streamed hash has to cover the kept part of the file as well as the new data
+		hasher.Reset()
+		if offset > 0 {
+			if _, err := io.Copy(hasher, io.NewSectionReader(outFile, 0, offset)); err != nil {
+				resp.Body.Close()
+				return result, fmt.Errorf("could not read temp file: %w", err)
+			}
+		} else if err := outFile.Truncate(0); err != nil {
+			resp.Body.Close()
+			return result, fmt.Errorf("could not reset temp file: %w", err)
+		}
+		if _, err := outFile.Seek(offset, io.SeekStart); err != nil {
+			resp.Body.Close()
+			return result, fmt.Errorf("could not seek temp file: %w", err)
+		}
+
+		// The bar is drawn only on a terminal, where it can redraw in place; redirected
+		// output would fill up with partial lines
+		var bar *terminalBar
+		if !opts.HideProgress && opts.ProgressMode == progressBar && isTerminal(os.Stderr) {
+			total := int64(-1)
+			if resp.ContentLength >= 0 {
+				total = offset + resp.ContentLength
+			}
+			bar = newTerminalBar(os.Stderr, filename, offset, total)
+		}
+
+		// Create a progress reader
+		var received int64
+		lastReport := time.Now()
+		progressReader := &progressReader{
+			reader: resp.Body,
+			onProgress: func(written int64) {
+				if bar != nil {
+					bar.add(written)
+				}
+				if opts.BytesReceived != nil {
+					opts.BytesReceived.Add(written)
+				}
+				if opts.Metrics != nil {
+					opts.Metrics.bytes.Add(written)
+				}
+				received += written
+				if opts.ProgressMode == progressLog && time.Since(lastReport) >= opts.ProgressInterval {
+					lastReport = time.Now()
+					logger.Info("Download progress",
+						"filename", filename,
+						"received", received,
+						"total", resp.ContentLength)
+				}
+			},
+		}
+
+		var body io.Reader = progressReader
+		if opts.Bandwidth != nil {
+			body = &rateLimitedReader{reader: progressReader, limiter: opts.Bandwidth}
+		}
+
+		// Copy with size limit
+		transferStart := time.Now()
+		written, err := io.Copy(io.MultiWriter(outFile, hasher), io.LimitReader(body, opts.maxSize()-offset+1))
+		transfer := time.Since(transferStart)
+		resp.Body.Close()
+		if bar != nil {
+			bar.finish()
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("error writing to %s: %w", writePath, err)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		written += offset
+		if written > opts.maxSize() {
+			lastErr = ErrFileTooLarge
+			if !opts.KeepFailed {
+				outFile.Truncate(0)
+				continue
+			}
+			// Move the oversized file aside and start the next attempt in a fresh one
+			outFile.Close()
+			if err := keepFailedFile(writePath, outputPath); err != nil {
+				logger.Warn("Could not keep failed download", "error", err)
+			}
+			if outFile, err = os.OpenFile(writePath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644); err != nil {
+				return result, fmt.Errorf("could not create %s: %w", writePath, err)
+			}
+			continue
+		}
+
+		if trace != nil {
+			opts.Timings.add(filename, trace.result(transfer))
+		}
+
+		remoteModified, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+		result.Bytes = written
+		if opts.MetaSidecar {
+			// A stubbed client may return a response without its request
+			finalURL := req.URL
+			if resp.Request != nil {
+				finalURL = resp.Request.URL
+			}
+			meta.FinalURL = finalURL.String()
+			meta.StatusCode = resp.StatusCode
+			meta.ContentType = resp.Header.Get("Content-Type")
+			meta.ContentLength = resp.ContentLength
+			meta.Finished = time.Now()
+			meta.BytesWritten = written
+			meta.Retries = attempt - 1
+		}
+
+		// Success - break retry loop
+		lastErr = nil
+		break
+	}
+
+	for _, n := range retries {
+		result.Retries += n
+	}
+	if lastErr != nil {
+		if errors.Is(lastErr, ErrInvalidContentType) {
+			outFile.Close()
+			os.Remove(writePath)
+		}
+		return result, lastErr
+	}
+
+	// Make sure what arrived is audio before it takes the final name
+	head := make([]byte, 10)
+	n, err := outFile.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return result, fmt.Errorf("could not read %s: %w", writePath, err)
+	}
+	if !looksLikeMP3(head[:n]) {
+		outFile.Close()
+		if !opts.KeepFailed {
+			os.Remove(writePath)
+		} else if err := keepFailedFile(writePath, outputPath); err != nil {
+			logger.Warn("Could not keep failed download", "error", err)
+			os.Remove(writePath)
+		}
+		return result, fmt.Errorf("%w: %s does not start with an MP3 frame or ID3 tag", ErrInvalidContentType, archive.ArchiveURL)
+	}
+
+	// Sync to ensure all data is written
+	if err := outFile.Sync(); err != nil {
+		return result, fmt.Errorf("failed to sync file: %w", err)
+	}
+
+	// Close the file before renaming
+	if err := outFile.Close(); err != nil {
+		return result, fmt.Errorf("failed to close file: %w", err)
+	}
+
+	// If we have a playlist ID, fetch and attach the playlist
+	var playlist string
+	var tracks []Track
+	if archive.PlaylistID != nil {
+		var content []byte
+		var links []string
+		var err error
+		tracks, links, err = fetchPlaylist(ctx, opts.apiClient(), opts.apiURL(), *archive.PlaylistID)
+		if err == nil {
+			meta.Playlist = tracks
+			playlist, err = formatPlaylist(tracks, opts.PlaylistTemplate)
+		}
+		if err == nil && !opts.Tags {
+			content, err = renderPlaylistFile(tracks, opts.PlaylistFormat, opts.PlaylistTemplate)
+		}
+		if err != nil {
+			meta.PlaylistError = err.Error()
+			if err := reportProblem(opts, "Failed to fetch playlist", err,
+				"playlist_id", *archive.PlaylistID); err != nil {
+				return result, err
+			}
+		} else if !opts.Tags {
+			// Create a playlist file; with -tags the playlist goes into the MP3 instead
+			playlistPath := playlistPath(outputPath, opts.PlaylistFormat)
+			if err := writeFile(playlistPath, content, 0644); err != nil {
+				if err := reportProblem(opts, "Failed to save playlist", err,
+					"path", playlistPath); err != nil {
+					return result, err
+				}
+			} else {
+				logger.Info("Saved playlist",
+					"path", playlistPath)
+			}
+		}
+
+		if err == nil && opts.FetchLinks {
+			if err := fetchLinks(ctx, opts.apiClient(), links, linksDir(outputPath)); err != nil {
+				if err := reportProblem(opts, "Failed to fetch playlist links", err,
+					"playlist_id", *archive.PlaylistID); err != nil {
+					return result, err
+				}
+			}
+		}
+	}
+
+	// Keep the episode's own description, which matters most for episodes without a playlist
+	if nfo := episodeInfo(archive); nfo != "" {
+		nfoPath := strings.TrimSuffix(outputPath, ".mp3") + ".nfo"
+		if err := writeFile(nfoPath, []byte(nfo), 0644); err != nil {
+			if err := reportProblem(opts, "Failed to save episode description", err,
+				"path", nfoPath); err != nil {
+				return result, err
+			}
+		} else {
+			logger.Info("Saved episode description", "path", nfoPath)
+		}
+	}
+
+	// Atomic rename from temp to final
+	if !opts.NoAtomic {
+		if err := os.Rename(tempFile, outputPath); err != nil {
+			return result, fmt.Errorf("failed to rename temp file: %w", err)
+		}
+	}
+	complete = true
+
+	meta.SHA256 = hex.EncodeToString(hasher.Sum(nil))
+	var chapters []chapter
+	if opts.Chapters && tracks != nil {
+		chapters, err = outputChapters(outputPath, tracks, opts.PlaylistTemplate)
+		if err != nil {
+			// Without times the playlist is still saved as a plain tracklist
+			logger.Info("Not writing chapters", "path", outputPath, "reason", err)
+		}
+	}
+	if !opts.Tags {
+		playlist = "" // Only -tags puts the tracklist itself in the MP3
+	}
+	if opts.Tags || len(chapters) > 0 {
+		if err := writeID3Tags(outputPath, archive, playlist, chapters, opts.baseURL(), opts.Location); err != nil {
+			if err := reportProblem(opts, "Failed to write ID3 tags", err,
+				"path", outputPath); err != nil {
+				return result, err
+			}
+		} else {
+			// The file on disk now differs from what was received
+			sum, err := hashFile(outputPath)
+			if err != nil {
+				return result, fmt.Errorf("could not hash tagged file: %w", err)
+			}
+			meta.SHA256 = sum
+		}
+	}
+	if opts.SetMtime {
+		// Set last, as writing tags changes the modification time
+		if err := setFileTime(outputPath, archiveFileTime(archive, remoteModified, opts.Location)); err != nil {
+			if err := reportProblem(opts, "Failed to set file time", err,
+				"path", outputPath); err != nil {
+				return result, err
+			}
+		}
+	}
+	if opts.Hashes != nil {
+		opts.Hashes.record(outputPath, meta.SHA256)
+	}
+	if opts.Seen != nil {
+		opts.Seen.record(archive.ArchiveURL, outputPath, meta.SHA256)
+	}
+	if err := opts.recordState(archive, outputPath, meta.SHA256, result.Bytes); err != nil {
+		if err := reportProblem(opts, "Failed to record download state", err,
+			"path", outputPath); err != nil {
+			return result, err
+		}
+	}
+	if opts.Checksums != nil {
+		if err := opts.Checksums.record(outputPath, meta.SHA256); err != nil {
+			if err := reportProblem(opts, "Failed to record checksum", err,
+				"path", outputPath); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	if opts.GlobalStore != "" {
+		if err := storeContent(opts.GlobalStore, outputPath, meta.SHA256); err != nil {
+			if err := reportProblem(opts, "Failed to deduplicate into global store", err,
+				"path", outputPath); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	if opts.MetaSidecar {
+		if err := writeMetaSidecar(outputPath, meta); err != nil {
+			if err := reportProblem(opts, "Failed to save download metadata", err,
+				"path", metaSidecarPath(outputPath)); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	logger.Info("Downloaded file",
+		"filename", filename,
+		requestIDAttr(result.RequestID))
+
+	// The download is complete, so an interrupted delay is not an error
+	if opts.Pacer == nil {
+		sleepContext(ctx, opts.delay())
+	}
+	return result, nil
+}
+
+// resumable reports whether the partial download at path, stopped by err, is worth keeping
+// for a later run: it has some content, and the run was cancelled or err may not recur
+func resumable(ctx context.Context, err error, path string) bool {
+	if info, statErr := os.Stat(path); statErr != nil || info.Size() == 0 {
+		return false
+	}
+	return ctx.Err() != nil || retryable(err)
+}
+
+// maxSize returns the largest archive accepted, in bytes
+func (o downloadOptions) maxSize() int64 {
+	if o.MaxFileSize > 0 {
+		return o.MaxFileSize
+	}
+	return maxFileSize
+}
+
+// preflightSize asks the server for the archive's size with a HEAD request and returns
+// ErrFileTooLarge if it is over the limit. If the server does not say, the download goes
+// ahead and the limit is enforced while streaming instead.
+func (o downloadOptions) preflightSize(ctx context.Context, archive Archive) error {
+	logger := slog.Default()
+	limit := o.maxSize()
+
+	size, err := headContentLength(ctx, o.downloadClient(), archive.ArchiveURL)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	switch {
+	case err != nil:
+		logger.Info("Could not get archive size before download, limiting while streaming",
+			"date", archive.PlaylistDate,
+			"limit", limit,
+			"error", err)
+		return nil
+	case size < 0:
+		logger.Info("Archive size not given before download, limiting while streaming",
+			"date", archive.PlaylistDate,
+			"limit", limit)
+		return nil
+	case size > limit:
+		logger.Warn("Skipping archive over the size limit",
+			"date", archive.PlaylistDate,
+			"size", size,
+			"limit", limit)
+		return fmt.Errorf("%w: %s is %d bytes, over the limit of %d", ErrFileTooLarge, archive.ArchiveURL, size, limit)
+	default:
+		logger.Info("Archive size within limit",
+			"date", archive.PlaylistDate,
+			"size", size,
+			"limit", limit)
+		return nil
+	}
+}
+
+// recordState adds the download of archive at path, with content hash sum and the size the
+// server sent if known, to the state file. It does nothing if there is no state file.
+func (o downloadOptions) recordState(archive Archive, path, sum string, remoteSize int64) error {
+	if o.State == nil {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(o.OutputDir, path)
+	if err != nil {
+		return err
+	}
+	return o.State.record(archive, rel, info.Size(), sum, remoteSize)
+}
+
+// recordLinked adds path, linked to a file with content hash sum saved earlier in the run,
+// to the state file and checksum manifest as if it had been downloaded
+func (o downloadOptions) recordLinked(archive Archive, path, sum string) error {
+	if o.Hashes != nil {
+		o.Hashes.record(path, sum)
+	}
+	if err := o.recordState(archive, path, sum, 0); err != nil {
+		if err := reportProblem(o, "Failed to record download state", err,
+			"path", path); err != nil {
+			return err
+		}
+	}
+	if o.Checksums != nil {
+		if err := o.Checksums.record(path, sum); err != nil {
+			if err := reportProblem(o, "Failed to record checksum", err,
+				"path", path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// present reports whether archive is already downloaded, by the state file or by a file
+// under its name, so a run would skip it
+func (o downloadOptions) present(archive Archive) bool {
+	if o.Force || o.Replace[stateKey(archive)] {
+		return false
+	}
+	if o.State != nil {
+		if _, ok := o.State.lookup(archive); ok {
+			return true
+		}
+	}
+	_, err := os.Stat(filepath.Join(o.OutputDir, o.archiveFilename(archive)))
+	return err == nil
+}
+
+// episodeInfo renders an archive's title and description as text, or "" if it has neither
+func episodeInfo(archive Archive) string {
+	title := strings.TrimSpace(archive.Title)
+	description := strings.TrimSpace(archive.Description)
+	if title == "" && description == "" {
+		return ""
+	}
+
+	var sb strings.Builder
+	if title != "" {
+		sb.WriteString(title + "\n")
+	}
+	fmt.Fprintf(&sb, "%s (%s)\n", archive.PlaylistDate, archive.ShowID)
+	if description != "" {
+		sb.WriteString("\n" + description + "\n")
+	}
+	return sb.String()
+}
+
+// audioContentTypes are the Content-Type values accepted for an archive download. Generic
+// binary types are allowed because some CDNs serve every file that way.
+var audioContentTypes = []string{
+	"audio/mpeg",
+	"audio/mp3",
+	"audio/mpeg3",
+	"audio/x-mpeg",
+	"audio/x-mpeg-3",
+	"audio/x-mp3",
+	"application/octet-stream",
+	"binary/octet-stream",
+}
+
+// checkContentType returns ErrInvalidContentType unless header names an audio type. A
+// missing header is accepted; the file is sniffed once downloaded anyway.
+func checkContentType(header string) error {
+	if header == "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil || !slices.Contains(audioContentTypes, strings.ToLower(mediaType)) {
+		return fmt.Errorf("%w: %q", ErrInvalidContentType, header)
+	}
+	return nil
+}
+
+// parseContentRange reads a Content-Range header of the form "bytes 100-199/1000" or
+// "bytes */1000". The size is -1 when the server gives it as "*"; the start is -1 for
+// the unsatisfied-range form.
+func parseContentRange(header string) (start, size int64, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes ")
+	if !found {
+		return 0, 0, false
+	}
+	byteRange, total, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, false
+	}
+
+	size = -1
+	if total != "*" {
+		n, err := strconv.ParseInt(total, 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		size = n
+	}
+
+	if byteRange == "*" {
+		return -1, size, true
+	}
+	first, _, found := strings.Cut(byteRange, "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, size, true
+}
+
+// runTestURL pushes a single URL through the normal download pipeline, bypassing the
+// archive-ID and archive-list lookups. Each run gets a fresh timestamped filename.
+func runTestURL(ctx context.Context, rawURL string, opts downloadOptions) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("not an http(s) URL: %q", rawURL)
+	}
+
+	archive := Archive{
+		ShowID:       "test-url",
+		ArchiveURL:   u.String(),
+		PlaylistDate: time.Now().Format("20060102-150405"),
+	}
+	opts.Delay = 0 // Nothing follows a one-off download
+
+	if _, err := downloadShow(ctx, archive, opts); err != nil {
+		return err
+	}
+
+	slog.Default().Info("Test download succeeded",
+		"url", archive.ArchiveURL,
+		"path", filepath.Join(opts.OutputDir, opts.archiveFilename(archive)))
+	return nil
+}
+
+// reportProblem logs a non-fatal problem with a download as a warning. In strict mode the
+// problem is returned as an error instead, so the download fails.
+func reportProblem(opts downloadOptions, msg string, err error, args ...any) error {
+	if opts.Strict {
+		return fmt.Errorf("%s (strict mode): %w", strings.ToLower(msg), err)
+	}
+	slog.Default().Warn(msg, append(args, "error", err)...)
+	return nil
+}
+
+// fetchPlaylist retrieves the tracks of a given playlist ID, along with any
+// http(s) links found in its track entries
+func fetchPlaylist(ctx context.Context, client HTTPClient, api, playlistID string) ([]Track, []string, error) {
+	url := fmt.Sprintf("%s/api/playlists/%s", api, playlistID)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch playlist: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("bad status fetching playlist: %s", resp.Status)
+	}
+
+	body, err := decodedBody(resp)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read playlist: %w", err)
+	}
+	defer body.Close()
+
+	var playlist struct {
+		Tracks []json.RawMessage `json:"tracks"`
+	}
+
+	if err := json.NewDecoder(body).Decode(&playlist); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode playlist: %w", err)
+	}
+
+	tracks := make([]Track, 0, len(playlist.Tracks))
+	var links []string
+	seen := make(map[string]bool)
+	for _, raw := range playlist.Tracks {
+		track, err := decodeTrack(raw)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to decode playlist track: %w", err)
+		}
+		tracks = append(tracks, track)
+
+		for _, link := range findLinks(raw) {
+			if !seen[link] {
+				seen[link] = true
+				links = append(links, link)
+			}
+		}
+	}
+
+	return tracks, links, nil
+}
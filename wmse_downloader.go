@@ -4,84 +4,25 @@
 // then fetches archive links from the API, and finally downloads each MP3 file with a pause
 // between requests to avoid overloading the server.
 
-// Package main provides a tool for downloading WMSE radio show archives.
-// It fetches MP3 files from the WMSE archive API and saves them locally.
-// The tool includes features for:
-// - Validating show IDs
-// - Fetching archive links
-// - Downloading MP3 files with progress tracking
-// - Handling retries and errors
-// - Skipping already downloaded files
-// - Attaching playlist information to MP3 files
+// Package main is the command line interface to the wmse package. It turns flags into
+// wmse.Options, then looks the show up, fetches its archive list and downloads each
+// episode through a wmse.Downloader.
 package main
 
 import (
 	"context"
-	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log/slog"
-	"net/http"
 	"os"
-	"path/filepath"
-	"regexp"
+	"slices"
 	"strings"
 	"time"
 
-	"github.com/schollz/progressbar/v3"
-	"golang.org/x/net/html"
+	"github.com/pdfinn/wmse_downloader/wmse"
 )
 
-// Constants for validation and limits
-const (
-	// maxShowIDLength is the maximum allowed length for a show ID
-	maxShowIDLength = 50
-	// maxResponseSize is the maximum allowed size for API responses (10MB)
-	maxResponseSize = 10 * 1024 * 1024
-	// maxFileSize is the maximum allowed size for downloaded MP3 files (500MB)
-	maxFileSize = 500 * 1024 * 1024
-	// maxArchiveLinks is the maximum number of archive links to process
-	maxArchiveLinks = 1000
-	// validShowIDRegex is the regular expression pattern for valid show IDs
-	validShowIDRegex = `^[a-zA-Z0-9_-]+$`
-	// baseURL is the base URL for the WMSE website
-	baseURL = "https://wmse.org"
-	// apiURL is the base URL for the WMSE API
-	apiURL = "https://wmse.fly.dev"
-)
-
-// Error definitions for the application
-var (
-	// ErrInvalidShowID is returned when the show ID is invalid
-	ErrInvalidShowID = errors.New("invalid show ID")
-	// ErrResponseTooLarge is returned when the API response is too large
-	ErrResponseTooLarge = errors.New("response too large")
-	// ErrFileTooLarge is returned when the downloaded file is too large
-	ErrFileTooLarge = errors.New("file too large")
-	// ErrInvalidContentType is returned when the content type is invalid
-	ErrInvalidContentType = errors.New("invalid content type")
-	// ErrTooManyLinks is returned when too many archive links are found
-	ErrTooManyLinks = errors.New("too many archive links")
-)
-
-// Show represents a WMSE show with its metadata
-type Show struct {
-	ID         string    `json:"show_id"`       // Unique identifier for the show
-	Name       string    `json:"show_name"`     // Name of the show
-	ArchiveURL string    `json:"archive_url"`   // URL to the MP3 archive
-	Date       time.Time `json:"playlist_date"` // Date of the show
-}
-
-// Archive represents a WMSE show archive entry
-type Archive struct {
-	ShowID       string  `json:"show_id"`       // Unique identifier for the show
-	ArchiveURL   string  `json:"archive_url"`   // URL to the MP3 archive
-	PlaylistID   *string `json:"playlist_id"`   // Optional playlist ID
-	PlaylistDate string  `json:"playlist_date"` // Date of the show
-}
-
 // Version information (set by goreleaser)
 var (
 	version = "dev"
@@ -89,424 +30,620 @@ var (
 	date    = "unknown"
 )
 
-// validateShowID ensures the show ID meets security requirements
-func validateShowID(id string) error {
-	if id == "" || len(id) > maxShowIDLength {
-		return fmt.Errorf("%w: empty or too long", ErrInvalidShowID)
-	}
-
-	matched, err := regexp.MatchString(validShowIDRegex, id)
-	if err != nil || !matched {
-		return fmt.Errorf("%w: contains invalid characters", ErrInvalidShowID)
-	}
-
-	return nil
-}
+func main() {
+	stats := runStats{started: time.Now()}
+	o := wmse.DefaultOptions()
 
-// sanitizeFilename ensures the filename is safe for filesystem operations
-func sanitizeFilename(filename string) string {
-	// Remove any directory traversal attempts
-	filename = filepath.Base(filename)
+	// Command‑line flags
+	showID := flag.String("show", "ded", "ID of the WMSE show to download archives for; several can be given separated by commas")
+	flag.StringVar(&o.OutputDir, "out", o.OutputDir, "Directory to save MP3 files")
+	flag.DurationVar(&o.Delay, "delay", o.Delay, "Delay between downloads to avoid hammering")
+	flag.BoolVar(&o.Debug, "debug", false, "Enable debug logging (same as -log-level debug)")
+	logLevelName := flag.String("log-level", "info", "Lowest level logged: "+strings.Join(logLevels, ", "))
+	quiet := flag.Bool("quiet", false, "Log only warnings and errors, and hide the progress bar; the results of the run are still reported")
+	logFile := flag.String("log-file", "", "Also write logs to this file, rotating it by size")
+	logMaxSize := flag.Int("log-max-size", 10, "Size in MB at which the -log-file is rotated")
+	logMaxFiles := flag.Int("log-max-files", 5, "Number of rotated -log-file copies to keep")
+	showVersion := flag.Bool("version", false, "Show version information")
+	describe := flag.Bool("describe", false, "Print a JSON description of all flags and exit")
+	configPath := flag.String("config", "", "Read settings from this JSON file of flag names and values; flags on the command line override it")
+	printConfigFlag := flag.Bool("print-config", false, "Print the effective settings, after merging -config and the command line, as a config file and exit")
+	completion := flag.String("completion", "", "Print a shell completion script (bash, zsh or fish) and exit")
+	flag.IntVar(&o.MaxFilenameLength, "max-filename-length", o.MaxFilenameLength, "Maximum length of generated file names in bytes")
+	order := flag.String("order", "desc", "Order to download archives in by playlist date: "+strings.Join(wmse.ArchiveOrders, ", "))
+	sinceLastRun := flag.Bool("since-last-run", false, "Download only archives dated after the newest one already in -out")
+	onlyIfChanged := flag.Bool("only-if-changed", false, "Print the archives that are new or changed upstream since they were downloaded as JSON, and download only those")
+	allowDuplicates := flag.Bool("allow-duplicates", false, "Download archives that share an MP3 URL with an earlier archive instead of skipping them")
+	limit := flag.Int("limit", 0, "Download only the N most recent archives, after -start-index and -end-index (0 for no limit)")
+	startIndex := flag.Int("start-index", 0, "Index of the first archive to download (0-based)")
+	endIndex := flag.Int("end-index", 0, "Index after the last archive to download (0 means the end of the list)")
+	testURL := flag.String("test-url", "", "Download only this URL into -out, skipping show lookup (for diagnosing a single link)")
+	keepLast := flag.Int("keep-last", 0, "Keep only the newest N episodes of the show on disk (reports only, unless -prune is set)")
+	prune := flag.Bool("prune", false, "Delete episodes beyond -keep-last")
+	flag.IntVar(&o.Concurrency, "concurrency", o.Concurrency, "Number of archives to download in parallel")
+	flag.BoolVar(&o.ConcurrencyAuto, "concurrency-auto", false, "Download in parallel, adding workers while throughput keeps improving")
+	flag.IntVar(&o.MaxWorkers, "max-workers", o.MaxWorkers, "Upper limit on parallel downloads for -concurrency-auto")
+	archiveIDFlag := flag.String("archive-id", "", "Use this archive ID instead of looking it up on the show's program page")
+	flag.DurationVar(&o.ArchiveCacheTTL, "archive-cache-ttl", o.ArchiveCacheTTL, "Reuse an archive list fetched less than this long ago (0 to always fetch)")
+	flag.BoolVar(&o.RefreshArchives, "refresh", false, "Ignore the cached archive list and fetch it from the API")
+	archivesFile := flag.String("archives-file", "", "Load the archive list from this JSON file instead of the WMSE API")
+	flag.BoolVar(&o.Timings, "timings", false, "Report DNS, connect, TLS, first-byte and transfer times for each download")
+	flag.BoolVar(&o.FetchLinks, "fetch-links", false, "Also download resources linked from each playlist into a per-episode folder")
+	flag.BoolVar(&o.Strict, "strict", false, "Fail a download if its playlist or other extras cannot be saved")
+	dryRunFlag := flag.Bool("dry-run", false, "List each archive with its file name and whether it would be downloaded or skipped, then exit without writing anything")
+	logFormat := flag.String("log-format", "text", "Log format: "+strings.Join(logFormats, ", ")+"; json also writes a summary of the run to stdout")
+	maxSize := flag.String("max-size", "500MB", "Largest archive to download, with an optional K, M or G suffix; larger ones are skipped after a HEAD request where the server gives the size")
+	maxBandwidth := flag.String("max-bandwidth", "", "Cap total download speed across all workers, in bytes per second with an optional K, M or G suffix (e.g. 2MB); 0 or empty for no limit")
+	flag.StringVar(&o.FilenameTemplate, "template", o.FilenameTemplate, "Go template for each file's path under -out, e.g. {{.Name}}/{{.PlaylistDate}}.mp3; fields: ShowID, PlaylistDate, Name, Show, Title")
+	preflight := flag.Bool("preflight", false, "Check that the show resolves to an archive list and the options are valid, then exit without downloading")
+	listPlaylistsFlag := flag.Bool("list-playlists", false, "Print the playlist of every archive to stdout, then exit without downloading")
+	playlistsOnly := flag.Bool("playlists-only", false, "Save the missing playlist file of each MP3 already in -out, then exit without downloading any audio")
+	estimateSizeFlag := flag.Bool("estimate-size", false, "Report the total size of the archives still to download, then exit without downloading")
+	verifyChecksums := flag.Bool("verify", false, "Re-hash the files listed in checksums.txt in -out and report any that are missing or corrupted, then exit without downloading")
+	verifyHTML := flag.Bool("verify-html-structure", false, "Check that the -show program page still has the markup the downloader relies on, then exit")
+	flag.BoolVar(&o.SkipMissingURL, "skip-missing-url", false, "Treat archives without an MP3 URL yet as skipped rather than failed")
+	maxRetries := flag.Int("max-retries", o.Retries.Other, "Times to retry a failed download; the -retries-* flags override it for one kind of error")
+	flag.IntVar(&o.Retries.ServerError, "retries-5xx", o.Retries.ServerError, "Times to retry a download after a 5xx server error")
+	flag.IntVar(&o.Retries.Network, "retries-network", o.Retries.Network, "Times to retry a download after a connection or DNS failure")
+	flag.IntVar(&o.Retries.Timeout, "retries-timeout", o.Retries.Timeout, "Times to retry a download after a timeout")
+	flag.BoolVar(&o.FinalVerify, "final-verify", false, "After the run, re-read every downloaded file and check it against the hash taken while downloading")
+	flag.IntVar(&o.VerifyConcurrency, "verify-concurrency", o.VerifyConcurrency, "Number of files hashed in parallel when verifying")
+	flag.StringVar(&o.PlaylistFormat, "playlist-format", o.PlaylistFormat, "Format of saved playlist files: "+strings.Join(wmse.PlaylistFormats, ", "))
+	flag.StringVar(&o.PlaylistTemplate, "playlist-template", o.PlaylistTemplate, "Go template for each playlist line; any field returned by the API can be used, e.g. {{.album}}")
+	flag.StringVar(&o.Backoff, "backoff", o.Backoff, "Retry delay strategy: "+strings.Join(wmse.BackoffNames, ", "))
+	flag.DurationVar(&o.BackoffBase, "backoff-base", o.BackoffBase, "Delay before the first retry")
+	flag.DurationVar(&o.BackoffCap, "backoff-cap", o.BackoffCap, "Longest delay between retries (0 for no limit)")
+	flag.BoolVar(&o.BackoffJitter, "backoff-jitter", o.BackoffJitter, "Wait a random time up to the backoff delay, so failed downloads don't all retry at once")
+	flag.BoolVar(&o.SavePage, "save-page", false, "Save the show's program page HTML in the output directory")
+	flag.BoolVar(&o.SavePageText, "save-page-text", false, "Also save a plain-text version of the program page (implies -save-page)")
+	flag.BoolVar(&o.ConcurrencySafeDelay, "concurrency-safe-delay", false, "Space download starts at least -delay apart across all workers instead of pausing after each download")
+	flag.BoolVar(&o.MetaSidecar, "meta-sidecar", false, "Write a .meta.json provenance record next to each downloaded file")
+	flag.BoolVar(&o.KeepFailed, "keep-failed", false, "Keep a download rejected for its content type or size as <name>.failed instead of deleting it, to see what the server sent")
+	flag.BoolVar(&o.NoAtomic, "no-atomic", false, "Write downloads directly to their final path instead of a temporary file that is renamed (for filesystems where rename misbehaves)")
+	proxy := flag.String("proxy", "", "Send all requests through this proxy (http://, https:// or socks5:// URL), overriding HTTP_PROXY and HTTPS_PROXY")
+	flag.StringVar(&o.BaseURL, "base-url", o.BaseURL, "WMSE website to read program pages from")
+	flag.StringVar(&o.APIURL, "api-url", o.APIURL, "WMSE API to read archive lists and playlists from")
+	flag.DurationVar(&o.APITimeout, "api-timeout", o.APITimeout, "Time limit for each page, archive list and playlist request")
+	flag.DurationVar(&o.DownloadTimeout, "download-timeout", o.DownloadTimeout, "Time limit for each MP3 download")
+	flag.IntVar(&o.BreakerFailures, "breaker-failures", o.BreakerFailures, "Pause all downloads after this many consecutive server, network or timeout failures (0 to never pause)")
+	flag.DurationVar(&o.BreakerCooldown, "breaker-cooldown", o.BreakerCooldown, "Length of the first pause after -breaker-failures; each further pause is twice as long")
+	flag.IntVar(&o.BreakerMaxCooldowns, "breaker-max-cooldowns", o.BreakerMaxCooldowns, "Pauses to try before giving up on the rest of the run")
+	requestIDHeader := flag.String("request-id-header", "", "Send a unique ID in this header (e.g. X-Request-ID) with every request and log it")
+	flag.StringVar(&o.GlobalStore, "global-store", "", "Keep each distinct MP3 once in this content-addressed directory and link episode files to it")
+	flag.StringVar(&o.Timezone, "timezone", o.Timezone, "Time zone playlist dates are interpreted in")
+	flag.BoolVar(&o.DeferRetries, "defer-retries", false, "Try each download once, then retry the failures in a second pass at the end of the run")
+	flag.DurationVar(&o.DeferRetriesCooldown, "defer-retries-cooldown", o.DeferRetriesCooldown, "Pause before the -defer-retries second pass")
+	notifyDone := flag.Bool("notify-done", false, "Show a desktop notification summarising the run when it finishes")
+	flag.BoolVar(&o.MatchByHash, "match-by-hash", false, "Hash existing MP3s in -out and skip archives whose content hash matches one, whatever its name")
+	flag.BoolVar(&o.AdaptiveDelay, "adaptive-delay", false, "Increase the delay between downloads automatically while the server is responding slowly")
+	flag.DurationVar(&o.LatencyHigh, "latency-high", o.LatencyHigh, "Response time above which -adaptive-delay doubles the delay")
+	flag.DurationVar(&o.LatencyLow, "latency-low", o.LatencyLow, "Response time below which -adaptive-delay eases the delay back towards -delay")
+	flag.DurationVar(&o.MaxAdaptiveDelay, "max-adaptive-delay", o.MaxAdaptiveDelay, "Longest delay -adaptive-delay will use")
+	flag.IntVar(&o.MaxConcurrentHosts, "max-concurrent-hosts", 0, "Limit the number of distinct hosts downloaded from at the same time (0 for no limit)")
+	flag.StringVar(&o.ProgressMode, "progress-mode", o.ProgressMode, "How to report progress: "+strings.Join(wmse.ProgressModes, ", "))
+	flag.DurationVar(&o.ProgressInterval, "progress-interval", o.ProgressInterval, "How often the log and line progress modes report")
+	metricsAddr := flag.String("metrics-addr", "", "Serve live download counters for Prometheus at /metrics on this address (e.g. localhost:9090)")
+	serveAddr := flag.String("serve", "", "Serve the output directory over HTTP on this address (e.g. localhost:8080), including downloads in progress")
+	flag.BoolVar(&o.DelayOnSkip, "delay-on-skip", false, "Also apply -delay after archives that are skipped because they are already downloaded")
+	flag.BoolVar(&o.Chapters, "chapters", false, "Mark each track of the playlist as an ID3 chapter in the MP3 when the playlist gives track times")
+	flag.BoolVar(&o.SetMtime, "set-mtime", o.SetMtime, "Set each downloaded MP3's modification time to the show's air date, or the server's Last-Modified time if the date is unknown")
+	flag.BoolVar(&o.Tags, "tags", false, "Write the show name, date and playlist into each MP3 as ID3v2 tags instead of a separate .txt playlist")
+	m3uName := flag.String("m3u", "", "Add the episodes downloaded in this run to this M3U playlist in the output directory (e.g. ded.m3u8)")
+	flag.BoolVar(&o.Force, "force", false, "Download every archive again, ignoring the download state file and files already present (same as -overwrite always)")
+	flag.StringVar(&o.Overwrite, "overwrite", o.Overwrite, "What to do with archives already downloaded: "+strings.Join(wmse.OverwriteModes, ", ")+"; if-different downloads again only when the server's copy has changed")
+	flag.BoolVar(&o.LogSkips, "log-skips", false, "Log each already-downloaded file instead of a single count at the end")
+	resume := flag.Bool("resume", false, "With several shows, skip those an interrupted run of the same -show list had finished, carrying on from the one it stopped in")
+	resumeAll := flag.Bool("resume-all", false, "Before the normal downloads, resume every unfinished download (.mp3.tmp) under -out that belongs to one of the shows")
+	mediaLibrary := flag.String("media-library", "", "Name and tag files for this media server: "+strings.Join(mediaLibraries, ", ")+"; sets -template, -tags and -chapters unless they are given")
+	concatPath := flag.String("concat", "", "Also append every archive, in order, to this single MP3 file (resumable)")
+	flag.Parse()
 
-	// Remove any non-alphanumeric characters except for dots and hyphens
-	reg := regexp.MustCompile(`[^a-zA-Z0-9.-]`)
-	filename = reg.ReplaceAllString(filename, "_")
+	// Where each flag that was set got its value; the command line wins over the config file
+	setBy := make(map[string]flagSource)
+	flag.Visit(func(f *flag.Flag) { setBy[f.Name] = fromCommandLine })
 
-	// Ensure it ends with .mp3
-	if !strings.HasSuffix(strings.ToLower(filename), ".mp3") {
-		filename += ".mp3"
+	var showConfigs []showConfig
+	if *configPath != "" {
+		var err error
+		if showConfigs, err = loadConfig(flag.CommandLine, *configPath); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(2)
+		}
+	}
+	if *mediaLibrary != "" {
+		if err := applyMediaLibrary(flag.CommandLine, *mediaLibrary); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if setBy[f.Name] == flagUnset {
+			setBy[f.Name] = fromSettings
+		}
+	})
+	if *printConfigFlag {
+		if err := printConfig(flag.CommandLine, showConfigs, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to print config: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
 
-	return filename
-}
-
-// getShowArchiveID gets the archive ID from the program page
-func getShowArchiveID(ctx context.Context, showID string) (string, error) {
-	logger := slog.Default()
+	// -max-retries is the budget for every kind of error not given its own
+	retries := wmse.UniformRetryPolicy(*maxRetries)
+	if setBy["retries-5xx"] != flagUnset {
+		retries.ServerError = o.Retries.ServerError
+	}
+	if setBy["retries-network"] != flagUnset {
+		retries.Network = o.Retries.Network
+	}
+	if setBy["retries-timeout"] != flagUnset {
+		retries.Timeout = o.Retries.Timeout
+	}
+	o.Retries = retries
 
-	// Validate show ID
-	if err := validateShowID(showID); err != nil {
-		return "", err
+	// Show version and exit if requested
+	if *showVersion {
+		fmt.Printf("WMSE Downloader v%s (%s) built at %s\n", version, commit, date)
+		os.Exit(0)
 	}
 
-	// Create request with context
-	url := fmt.Sprintf("%s/program/%s/", baseURL, showID)
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
+	if *describe {
+		if err := describeFlags(flag.CommandLine, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to describe flags: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
 
-	// Add headers to look like a browser
-	req.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.4 Safari/605.1.15")
-	req.Header.Set("Accept-Language", "en-US,en;q=0.9")
+	if *completion != "" {
+		if err := writeCompletion(flag.CommandLine, *completion, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write completion script: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 
-	// Perform request
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+	// Setup logging with appropriate level
+	logLevel, err := parseLogLevel(*logLevelName)
 	if err != nil {
-		return "", fmt.Errorf("failed to fetch program page: %w", err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("program page returned non-200 status: %s", resp.Status)
+	if *quiet && (o.Debug || setBy["log-level"] != flagUnset) {
+		fmt.Fprintln(os.Stderr, "-quiet cannot be combined with -debug or -log-level")
+		os.Exit(1)
+	}
+	switch {
+	case *quiet:
+		logLevel = slog.LevelWarn
+		if setBy["progress-mode"] == flagUnset {
+			o.ProgressMode = "none"
+		}
+	case o.Debug && setBy["log-level"] == flagUnset:
+		logLevel = slog.LevelDebug
 	}
+	o.Debug = logLevel <= slog.LevelDebug
 
-	// Parse HTML
-	doc, err := html.Parse(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to parse HTML: %w", err)
-	}
-
-	// Find the wmse-archive element and get its show-id attribute
-	var archiveID string
-	var f func(*html.Node)
-	f = func(n *html.Node) {
-		if n.Type == html.ElementNode && n.Data == "wmse-archive" {
-			for _, attr := range n.Attr {
-				if attr.Key == "show-id" {
-					archiveID = attr.Val
-					return
-				}
-			}
+	// Optionally copy the log to a rotating file
+	var logOutput io.Writer = os.Stderr
+	if *logFile != "" {
+		if *logMaxSize < 1 || *logMaxFiles < 0 {
+			fmt.Fprintln(os.Stderr, "-log-max-size must be at least 1 and -log-max-files must not be negative")
+			os.Exit(1)
 		}
-		for c := n.FirstChild; c != nil; c = c.NextSibling {
-			f(c)
+		rf, err := openRotatingFile(*logFile, int64(*logMaxSize)*1024*1024, *logMaxFiles)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to open log file: %v\n", err)
+			os.Exit(1)
 		}
+		defer rf.Close()
+		logOutput = io.MultiWriter(os.Stderr, rf)
 	}
-	f(doc)
 
-	if archiveID == "" {
-		return "", fmt.Errorf("could not find archive ID on page")
+	handler, err := newLogHandler(*logFormat, logOutput, logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
+	logger := slog.New(handler)
+	slog.SetDefault(logger)
 
-	logger.Info("Found archive ID", "id", archiveID)
-	return archiveID, nil
-}
-
-// fetchArchives gets the list of archives from the API
-func fetchArchives(ctx context.Context, archiveID string) ([]Archive, error) {
-	logger := slog.Default()
+	// The results of the run are reported even when quieter levels are filtered out
+	resultLogger := logger
+	if logLevel > slog.LevelInfo {
+		resultHandler, _ := newLogHandler(*logFormat, logOutput, slog.LevelInfo)
+		resultLogger = slog.New(resultHandler)
+	}
 
-	// Create request with context
-	url := fmt.Sprintf("%s/api/shows/%s", apiURL, archiveID)
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+	size, err := wmse.ParseByteSize(*maxSize)
+	if err != nil || size <= 0 {
+		logger.Error("Invalid -max-size", "value", *maxSize, "error", err)
+		os.Exit(1)
 	}
+	o.MaxFileSize = size
 
-	// Add headers
-	req.Header.Set("Accept", "application/json")
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.4 Safari/605.1.15")
+	if *maxBandwidth != "" {
+		bandwidth, err := wmse.ParseByteSize(*maxBandwidth)
+		if err != nil {
+			logger.Error("Invalid -max-bandwidth", "error", err)
+			os.Exit(1)
+		}
+		o.MaxBandwidth = bandwidth
+	}
 
-	// Perform request
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to fetch archives: %w", err)
+	if *prune && *keepLast <= 0 {
+		logger.Error("-prune requires -keep-last to be greater than 0")
+		os.Exit(1)
+	}
+	if !slices.Contains(wmse.ArchiveOrders, *order) {
+		logger.Error("Invalid -order", "order", *order, "want", strings.Join(wmse.ArchiveOrders, ", "))
+		os.Exit(1)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API returned non-200 status: %s", resp.Status)
+	if *dryRunFlag {
+		o.ArchiveCacheTTL = 0 // A dry run writes nothing, not even the cache
 	}
 
-	// Parse JSON response
-	var archives []Archive
-	if err := json.NewDecoder(resp.Body).Decode(&archives); err != nil {
-		return nil, fmt.Errorf("failed to parse JSON response: %w", err)
+	// One transport for every request, so connections are pooled and the proxy applies to all
+	transport, err := wmse.NewTransport(*proxy)
+	if err != nil {
+		logger.Error("Invalid -proxy", "error", err)
+		os.Exit(1)
+	}
+	o.Transport = transport
+	if *requestIDHeader != "" {
+		o.Transport = &requestIDTransport{header: *requestIDHeader, base: transport}
 	}
 
-	logger.Info("Found archives",
-		"count", len(archives),
-		"archive_id", archiveID)
+	// Catch an unusable -out now rather than after the archives have been looked up
+	readOnly := *dryRunFlag || *listPlaylistsFlag || *estimateSizeFlag || *verifyChecksums || *verifyHTML
+	if o.OutputDir, err = prepareOutputDir(o.OutputDir, !readOnly); err != nil {
+		logger.Error("Invalid -out", "error", err)
+		os.Exit(1)
+	}
+	if (readOnly || *preflight) && (o.SavePage || o.SavePageText) {
+		logger.Info("Not saving program page: nothing is written in this mode")
+		o.SavePage, o.SavePageText = false, false
+	}
 
-	return archives, nil
-}
+	d, err := wmse.New(o)
+	if err != nil {
+		logger.Error("Invalid options", "error", err)
+		os.Exit(1)
+	}
 
-// progressReader wraps an io.Reader to track progress
-type progressReader struct {
-	reader     io.Reader
-	bar        *progressbar.ProgressBar
-	onProgress func(written int64)
-}
+	// Ctrl-C stops the run cleanly; a second one exits at once
+	runCtx, stop := interruptContext(context.Background())
+	defer stop()
 
-func (pr *progressReader) Read(p []byte) (int, error) {
-	n, err := pr.reader.Read(p)
-	if n > 0 {
-		pr.bar.Add(n)
-		if pr.onProgress != nil {
-			pr.onProgress(int64(n))
+	if *verifyChecksums {
+		bad, err := d.VerifyChecksums()
+		if err != nil {
+			logger.Error("Checksum verification failed", "error", err)
+			os.Exit(1)
+		}
+		if bad > 0 {
+			os.Exit(1)
 		}
+		return
 	}
-	return n, err
-}
-
-// downloadShow downloads a single show's MP3 file and attaches playlist information if available
-func downloadShow(archive Archive, outputDir string, delay time.Duration, debug bool) error {
-	logger := slog.Default()
 
-	if archive.ArchiveURL == "" {
-		return fmt.Errorf("no MP3 URL available for archive: %s", archive.ShowID)
+	if *testURL != "" {
+		if err := d.DownloadURL(runCtx, *testURL); err != nil {
+			logger.Error("Test download failed", "url", *testURL, "error", err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	// Create a filename from the show date and ID
-	filename := fmt.Sprintf("%s_%s.mp3", archive.PlaylistDate, archive.ShowID)
-	filename = sanitizeFilename(filename)
-	outputPath := filepath.Join(outputDir, filename)
+	if *serveAddr != "" {
+		d.Serve(*serveAddr)
+	}
+	if *metricsAddr != "" {
+		d.ServeMetrics(*metricsAddr)
+	}
 
-	// Check if file already exists
-	if _, err := os.Stat(outputPath); err == nil {
-		logger.Info("Skipping existing file", "filename", filename)
-		return nil
+	shows := parseShows(*showID)
+	if len(showConfigs) > 0 && setBy["show"] != fromCommandLine {
+		shows = nil
+		for _, cfg := range showConfigs {
+			shows = append(shows, cfg.Show)
+		}
+	}
+	if len(shows) == 0 {
+		logger.Error("No show given with -show")
+		os.Exit(1)
+	}
+	if len(shows) > 1 && (*archivesFile != "" || *archiveIDFlag != "") {
+		logger.Error("-archives-file and -archive-id describe a single show and cannot be used with several")
+		os.Exit(1)
+	}
+	if len(shows) > 1 && *concatPath != "" {
+		logger.Error("-concat exports a single show and cannot be used with several")
+		os.Exit(1)
 	}
 
-	logger.Info("Downloading show",
-		"date", archive.PlaylistDate,
-		"url", archive.ArchiveURL)
+	logger.Info("Starting archive download",
+		"shows", strings.Join(shows, ","),
+		"output_dir", o.OutputDir,
+		"debug", o.Debug)
 
-	// Create output directory if needed
-	if err := os.MkdirAll(outputDir, 0755); err != nil {
-		return fmt.Errorf("could not create output directory: %w", err)
-	}
+	// Create context with timeout for the checks and listings
+	ctx, cancel := context.WithTimeout(runCtx, lookupTimeout)
+	defer cancel()
 
-	// Stream to temporary file first
-	tempFile := outputPath + ".tmp"
-	outFile, err := os.Create(tempFile)
-	if err != nil {
-		return fmt.Errorf("could not create temp file %s: %w", tempFile, err)
-	}
-	defer func() {
-		outFile.Close()
-		if err != nil {
-			os.Remove(tempFile)
+	if *verifyHTML {
+		ok := true
+		for _, show := range shows {
+			if err := d.VerifyHTMLStructure(ctx, show); err != nil {
+				logger.Error("WMSE program page check failed", "show_id", show, "error", err)
+				ok = false
+				continue
+			}
+			logger.Info("WMSE program page markup looks as expected", "show_id", show)
 		}
-	}()
-
-	// Retry logic for downloads
-	maxRetries := 3
-	var lastErr error
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		if attempt > 1 {
-			logger.Info("Retrying download",
-				"attempt", attempt,
-				"max_retries", maxRetries,
-				"previous_error", lastErr)
-			time.Sleep(time.Second * time.Duration(attempt*2)) // Exponential backoff
+		if !ok {
+			os.Exit(1)
 		}
+		return
+	}
 
-		// Create request with longer timeout
-		req, err := http.NewRequest("GET", archive.ArchiveURL, nil)
-		if err != nil {
-			lastErr = fmt.Errorf("failed to create request: %w", err)
+	sel := selection{
+		ArchivesFile:    *archivesFile,
+		ArchiveID:       *archiveIDFlag,
+		StartIndex:      *startIndex,
+		EndIndex:        *endIndex,
+		Limit:           *limit,
+		Order:           *order,
+		SinceLastRun:    *sinceLastRun,
+		AllowDuplicates: *allowDuplicates,
+	}
+	savePage := o.SavePage || o.SavePageText
+
+	// Shows with their own settings in the config file get their own downloader
+	setups := make(map[string]showSetup)
+	for _, show := range shows {
+		setups[show] = showSetup{d: d, sel: sel, out: o.OutputDir}
+	}
+	for _, cfg := range showConfigs {
+		if _, ok := setups[cfg.Show]; !ok || len(cfg.Settings) == 0 {
 			continue
 		}
-		req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.4 Safari/605.1.15")
-
-		// Use a longer timeout for downloads
-		client := &http.Client{
-			Timeout: 30 * time.Minute,
+		showOpts, showSel, err := applyShowConfig(o, sel, cfg, setBy)
+		if err == nil {
+			showOpts.OutputDir, err = prepareOutputDir(showOpts.OutputDir, !readOnly)
+		}
+		var showD *wmse.Downloader
+		if err == nil {
+			showD, err = d.WithOptions(showOpts)
 		}
-		resp, err := client.Do(req)
 		if err != nil {
-			lastErr = fmt.Errorf("failed to GET %s: %w", archive.ArchiveURL, err)
-			continue
+			logger.Error("Invalid show settings in config file", "show_id", cfg.Show, "error", err)
+			os.Exit(1)
 		}
+		setups[cfg.Show] = showSetup{d: showD, sel: showSel, out: showOpts.OutputDir}
+	}
 
-		if resp.StatusCode != http.StatusOK {
-			resp.Body.Close()
-			lastErr = fmt.Errorf("bad status downloading %s: %s", archive.ArchiveURL, resp.Status)
-			continue
-		}
+	// Checks and listings that stop short of downloading
+	if *preflight || *dryRunFlag || *listPlaylistsFlag || *estimateSizeFlag || *playlistsOnly {
+		ok := true
+		for _, show := range shows {
+			setup := setups[show]
+			archives, err := resolveArchives(ctx, setup.d, show, setup.sel, savePage)
+			if err == nil && *onlyIfChanged {
+				archives, err = onlyChanged(ctx, setup.d, show, archives, os.Stdout)
+			}
+			if err != nil {
+				logger.Error("Could not list archives", "show_id", show, "error", err)
+				ok = false
+				continue
+			}
 
-		// Create progress bar
-		bar := progressbar.NewOptions64(
-			resp.ContentLength,
-			progressbar.OptionSetDescription(fmt.Sprintf("Downloading %s", filename)),
-			progressbar.OptionSetWriter(os.Stderr),
-			progressbar.OptionShowBytes(true),
-			progressbar.OptionSetWidth(15),
-			progressbar.OptionThrottle(65*time.Millisecond),
-			progressbar.OptionShowCount(),
-			progressbar.OptionOnCompletion(func() {
-				fmt.Fprint(os.Stderr, "\n")
-			}),
-			progressbar.OptionSpinnerType(14),
-			progressbar.OptionFullWidth(),
-			progressbar.OptionSetRenderBlankState(true),
-		)
-
-		// Create a progress reader
-		progressReader := &progressReader{
-			reader: resp.Body,
-			bar:    bar,
-			onProgress: func(written int64) {
-				if debug && written%1024 == 0 { // Only log if debug is enabled
-					logger.Debug("Download progress",
-						"filename", filename,
-						"written", written,
-						"total", resp.ContentLength)
+			// Everything a run needs before downloading has now been resolved
+			switch {
+			case *preflight:
+				logger.Info("Preflight check passed",
+					"show_id", show,
+					"archives", len(archives),
+					"output_dir", o.OutputDir)
+			case *dryRunFlag:
+				err = setup.d.DryRun(ctx, archives, os.Stdout)
+			case *listPlaylistsFlag:
+				err = setup.d.ListPlaylists(runCtx, archives, os.Stdout)
+			case *playlistsOnly:
+				saved, failed := setup.d.BackfillPlaylists(runCtx, archives)
+				logger.Info("Playlist backfill finished",
+					"show_id", show,
+					"saved", saved,
+					"failed", failed)
+				if failed > 0 || runCtx.Err() != nil {
+					ok = false
 				}
-			},
-		}
-
-		// Copy with size limit
-		written, err := io.Copy(outFile, io.LimitReader(progressReader, maxFileSize+1))
-		resp.Body.Close()
-		if err != nil {
-			lastErr = fmt.Errorf("error writing to %s: %w", tempFile, err)
-			continue
+			default:
+				setup.d.EstimateSize(ctx, archives, os.Stdout)
+			}
+			if err != nil {
+				logger.Error("Failed to write listing", "show_id", show, "error", err)
+				os.Exit(1)
+			}
 		}
-		if written > maxFileSize {
-			lastErr = ErrFileTooLarge
-			continue
+		if !ok {
+			os.Exit(1)
 		}
-
-		// Success - break retry loop
-		lastErr = nil
-		break
+		return
 	}
 
-	if lastErr != nil {
-		return lastErr
+	// Runs of several shows keep a record of those finished, for -resume
+	var progress *runProgress
+	if len(shows) > 1 {
+		if progress, err = newRunProgress(o.OutputDir, shows, *resume); err != nil {
+			logger.Error("Could not resume the run", "error", err)
+			os.Exit(1)
+		}
 	}
+	finished := 0 // Shows skipped as finished by the interrupted run
 
-	// Sync to ensure all data is written
-	if err := outFile.Sync(); err != nil {
-		return fmt.Errorf("failed to sync file: %w", err)
+	// Downloads an earlier run left unfinished go first, for each show
+	var resumed map[string]showRun
+	var listed map[string][]wmse.Archive
+	if *resumeAll {
+		if resumed, listed, err = resumePartials(runCtx, shows, setups, savePage); err != nil {
+			logger.Error("Could not resume unfinished downloads", "error", err)
+			os.Exit(1)
+		}
 	}
 
-	// Close the file before renaming
-	if err := outFile.Close(); err != nil {
-		return fmt.Errorf("failed to close file: %w", err)
-	}
+	// Download each show in turn; one that cannot be listed doesn't stop the rest
+	var runs []showRun
+	for _, show := range shows {
+		setup := setups[show]
+		prior, hasPrior := resumed[show]
+		if runCtx.Err() != nil {
+			// Stopped while resuming; what was resumed is still reported
+			if hasPrior {
+				runs = append(runs, prior)
+			}
+			continue
+		}
+		if progress != nil && progress.done(show) && !hasPrior {
+			logger.Info("Skipping show finished before the run was interrupted", "show_id", show)
+			finished++
+			continue
+		}
 
-	// If we have a playlist ID, fetch and attach the playlist
-	if archive.PlaylistID != nil {
-		playlist, err := fetchPlaylist(*archive.PlaylistID)
-		if err != nil {
-			logger.Warn("Failed to fetch playlist",
-				"playlist_id", *archive.PlaylistID,
-				"error", err)
+		run := showRun{Show: show}
+		if archives, ok := listed[show]; ok {
+			run.Archives, run.Err = selectArchives(setup.d, show, archives, setup.sel)
 		} else {
-			// Create a playlist file
-			playlistPath := strings.TrimSuffix(outputPath, ".mp3") + ".txt"
-			if err := os.WriteFile(playlistPath, []byte(playlist), 0644); err != nil {
-				logger.Warn("Failed to save playlist",
-					"path", playlistPath,
-					"error", err)
-			} else {
-				logger.Info("Saved playlist",
-					"path", playlistPath)
+			run.Archives, run.Err = resolveArchives(runCtx, setup.d, show, setup.sel, savePage)
+		}
+		if run.Err == nil && *onlyIfChanged {
+			run.Archives, run.Err = onlyChanged(runCtx, setup.d, show, run.Archives, os.Stdout)
+		}
+		if run.Err != nil {
+			logger.Error("Could not list archives", "show_id", show, "error", run.Err)
+			run.Archives, run.Outcomes = prior.Archives, prior.Outcomes
+			runs = append(runs, run)
+			stats.add(run)
+			stats.failed++
+			if runCtx.Err() != nil {
+				break
 			}
+			continue
 		}
-	}
-
-	// Atomic rename from temp to final
-	if err := os.Rename(tempFile, outputPath); err != nil {
-		return fmt.Errorf("failed to rename temp file: %w", err)
-	}
 
-	logger.Info("Downloaded file",
-		"filename", filename)
+		if hasPrior {
+			run.Archives = withoutArchives(run.Archives, prior.Archives)
+		}
+		run.Outcomes = setup.d.DownloadAll(runCtx, run.Archives)
+		if hasPrior {
+			run.Archives = append(prior.Archives, run.Archives...)
+			run.Outcomes = append(prior.Outcomes, run.Outcomes...)
+		}
+		runs = append(runs, run)
+		if runCtx.Err() != nil {
+			break
+		}
 
-	time.Sleep(delay)
-	return nil
-}
+		downloaded, skipped, showFailed := stats.add(run)
 
-// fetchPlaylist retrieves the playlist for a given playlist ID
-func fetchPlaylist(playlistID string) (string, error) {
-	url := fmt.Sprintf("%s/api/playlists/%s", apiURL, playlistID)
-	resp, err := http.Get(url)
-	if err != nil {
-		return "", fmt.Errorf("failed to fetch playlist: %w", err)
-	}
-	defer resp.Body.Close()
+		if *concatPath != "" {
+			if err := setup.d.Concat(*concatPath, run.Archives, run.Outcomes); err != nil {
+				logger.Error("Failed to update concatenated export", "error", err)
+				os.Exit(1)
+			}
+		}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("bad status fetching playlist: %s", resp.Status)
-	}
+		if skipped > 0 && !o.LogSkips {
+			logger.Info("Files already present, skipped", "show_id", show, "count", skipped)
+		}
 
-	var playlist struct {
-		Tracks []struct {
-			Artist string `json:"artist"`
-			Title  string `json:"title"`
-		} `json:"tracks"`
-	}
+		if showFailed > 0 {
+			logger.Error("Some downloads failed", "show_id", show, "count", showFailed)
+		} else if progress != nil {
+			if err := progress.markDone(show); err != nil {
+				logger.Warn("Failed to record run progress", "show_id", show, "error", err)
+			}
+		}
 
-	if err := json.NewDecoder(resp.Body).Decode(&playlist); err != nil {
-		return "", fmt.Errorf("failed to decode playlist: %w", err)
-	}
+		if *keepLast > 0 {
+			if err := setup.d.Prune(run.Archives, *keepLast, downloaded, *prune); err != nil {
+				logger.Error("Failed to prune old episodes", "show_id", show, "error", err)
+				os.Exit(1)
+			}
+		}
 
-	var sb strings.Builder
-	for _, track := range playlist.Tracks {
-		sb.WriteString(fmt.Sprintf("%s - %s\n", track.Artist, track.Title))
+		// After pruning, so removed episodes drop out of the playlist
+		if *m3uName != "" {
+			if err := setup.d.UpdateM3U(*m3uName, run.Archives, run.Outcomes); err != nil {
+				logger.Error("Failed to update M3U playlist", "error", err)
+			}
+		}
 	}
 
-	return sb.String(), nil
-}
-
-func main() {
-	// Command‑line flags
-	showID := flag.String("show", "ded", "ID of the WMSE show to download archives for")
-	outDir := flag.String("out", "./archives", "Directory to save MP3 files")
-	delay := flag.Duration("delay", 5*time.Second, "Delay between downloads to avoid hammering")
-	debug := flag.Bool("debug", false, "Enable debug logging")
-	showVersion := flag.Bool("version", false, "Show version information")
-	flag.Parse()
-
-	// Show version and exit if requested
-	if *showVersion {
-		fmt.Printf("WMSE Downloader v%s (%s) built at %s\n", version, commit, date)
-		os.Exit(0)
+	if runCtx.Err() != nil {
+		completed, total := 0, 0
+		for _, run := range runs {
+			for _, outcome := range run.Outcomes {
+				if outcome.Err == nil {
+					completed++
+				}
+			}
+			total += len(run.Archives)
+		}
+		logger.Warn("Run interrupted",
+			"completed", completed,
+			"remaining", total-completed,
+			"shows_not_started", len(shows)-len(runs)-finished)
+		if *logFormat == "json" {
+			if err := writeSummary(os.Stdout, summarizeShows(runs)); err != nil {
+				logger.Error("Failed to write run summary", "error", err)
+			}
+		}
+		stop()
+		os.Exit(interruptedExitCode)
 	}
 
-	// Setup logging with appropriate level
-	logLevel := slog.LevelInfo
-	if *debug {
-		logLevel = slog.LevelDebug
+	if progress != nil {
+		if err := progress.finish(); err != nil {
+			logger.Warn("Failed to remove run progress file", "error", err)
+		}
 	}
 
-	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-		Level: logLevel,
-	}))
-	slog.SetDefault(logger)
-
-	logger.Info("Starting archive download",
-		"show_id", *showID,
-		"output_dir", *outDir,
-		"debug", *debug)
+	verifyFailed := d.FinalVerify()
 
-	// Create context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
-	defer cancel()
-
-	// First get the archive ID from the program page
-	archiveID, err := getShowArchiveID(ctx, *showID)
-	if err != nil {
-		logger.Error("Failed to get archive ID", "error", err)
-		os.Exit(1)
+	if *notifyDone {
+		summary := fmt.Sprintf("%s: %d downloaded, %d skipped, %d failed", strings.Join(shows, ", "), stats.downloaded, stats.skipped, stats.failed)
+		if verifyFailed > 0 {
+			summary += fmt.Sprintf(", %d failed verification", verifyFailed)
+		}
+		notifyDesktop("WMSE download finished", summary)
 	}
 
-	// Then fetch archives from the API
-	archives, err := fetchArchives(ctx, archiveID)
-	if err != nil {
-		logger.Error("Failed to fetch archives", "error", err)
-		os.Exit(1)
+	if *logFormat == "json" {
+		if err := writeSummary(os.Stdout, summarizeShows(runs)); err != nil {
+			logger.Error("Failed to write run summary", "error", err)
+		}
+	} else {
+		resultLogger.Info("Run finished",
+			"shows", len(runs),
+			"archives", stats.archives,
+			"downloaded", stats.downloaded,
+			"skipped", stats.skipped,
+			"failed", stats.failed,
+			"failed_verification", verifyFailed,
+			"bytes", stats.bytes,
+			"elapsed", time.Since(stats.started).Round(time.Millisecond))
 	}
 
-	if len(archives) == 0 {
-		logger.Error("No archives found", "show_id", *showID)
-		os.Exit(1)
+	if *serveAddr != "" {
+		logger.Info("Downloads finished; still serving the output directory, press Ctrl-C to stop",
+			"addr", *serveAddr)
+		<-runCtx.Done()
 	}
 
-	// Download each show
-	for _, archive := range archives {
-		if err := downloadShow(archive, *outDir, *delay, *debug); err != nil {
-			logger.Error("Download failed",
-				"archive", archive.ShowID,
-				"error", err)
-		}
+	if stats.failed > 0 || verifyFailed > 0 {
+		os.Exit(1)
 	}
 }